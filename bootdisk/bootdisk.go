@@ -0,0 +1,258 @@
+// Package bootdisk builds a disk image that OpenCore can start a recovery
+// image from: a GUID partition table with one FAT32 EFI system partition,
+// holding the DMG and chunklist in com.apple.recovery.boot and optionally an
+// OpenCore EFI folder.
+//
+// The image is written directly in Go, so no formatting or mounting tools
+// are needed. It is a raw disk, which qemu-img can convert to other formats.
+package bootdisk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// RecoveryDir is the folder OpenCore looks for recovery images in.
+const RecoveryDir = "com.apple.recovery.boot"
+
+// Names of the image files in RecoveryDir
+const (
+	ImageName     = "BaseSystem.dmg"
+	ChunklistName = "BaseSystem.chunklist"
+)
+
+// DefaultLabel is the volume label used unless another is given.
+const DefaultLabel = "EFI"
+
+// MinSizeMB is the smallest disk with room for a FAT32 partition.
+const MinSizeMB = 40
+
+var errNoSpace = errors.New("not enough space on the disk")
+
+// Options describes the disk to build.
+type Options struct {
+	DMG       string // recovery image, stored as BaseSystem.dmg
+	Chunklist string // its chunklist, stored as BaseSystem.chunklist
+	EFIDir    string // folder copied to /EFI, such as an OpenCore EFI folder or one holding it
+	SizeMB    int    // size of the disk, 0 to fit the files with some room to spare
+	Label     string // volume label, up to 11 characters
+}
+
+// node is a file or folder on the FAT32 volume.
+type node struct {
+	name     string
+	source   string // file copied in, empty for folders
+	size     int64
+	dir      bool
+	root     bool
+	children []*node
+	short    [11]byte // 8.3 name
+	long     bool     // whether long name entries are needed too
+	cluster  uint32
+	clusters uint32
+}
+
+// entryCount returns the number of directory entries of the folder n.
+func (n *node) entryCount() int {
+	count := 2 // . and .., or the volume label in the root folder
+	if n.root {
+		count = 1
+	}
+	for _, child := range n.children {
+		count++
+		if child.long {
+			count += (len(utf16.Encode([]rune(child.name))) + lfnChars - 1) / lfnChars
+		}
+	}
+	return count
+}
+
+// folder returns the folder called name in n, creating it if needed.
+func (n *node) folder(name string) *node {
+	for _, child := range n.children {
+		if child.dir && strings.EqualFold(child.name, name) {
+			return child
+		}
+	}
+	child := &node{name: name, dir: true}
+	n.children = append(n.children, child)
+	return child
+}
+
+// add adds the file at source to n as path, a slash separated path.
+func (n *node) add(path, source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(path, "/")
+	for _, part := range parts[:len(parts)-1] {
+		n = n.folder(part)
+	}
+	name := parts[len(parts)-1]
+	for _, child := range n.children {
+		if strings.EqualFold(child.name, name) {
+			return fmt.Errorf("%s is on the disk twice", path)
+		}
+	}
+	n.children = append(n.children, &node{name: name, source: source, size: info.Size()})
+	return nil
+}
+
+// tree returns the files and folders of the volume.
+func tree(opts Options) (*node, error) {
+	root := &node{dir: true, root: true}
+	if err := root.add(RecoveryDir+"/"+ImageName, opts.DMG); err != nil {
+		return nil, err
+	}
+	if opts.Chunklist != "" {
+		if err := root.add(RecoveryDir+"/"+ChunklistName, opts.Chunklist); err != nil {
+			return nil, err
+		}
+	}
+	if opts.EFIDir != "" {
+		// Take the EFI folder inside the one given if there is one
+		dir := opts.EFIDir
+		if info, err := os.Stat(filepath.Join(dir, "EFI")); err == nil && info.IsDir() {
+			dir = filepath.Join(dir, "EFI")
+		}
+		if err := addFolder(root.folder("EFI"), dir); err != nil {
+			return nil, err
+		}
+	}
+	sortTree(root)
+	return root, nil
+}
+
+// addFolder adds the contents of the folder dir to n.
+func addFolder(n *node, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a folder", dir)
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			folder := n
+			for _, part := range strings.Split(rel, "/") {
+				folder = folder.folder(part)
+			}
+			return nil
+		}
+		return n.add(rel, path)
+	})
+}
+
+// sortTree puts the contents of each folder in name order, keeping the
+// recovery folder first in the root folder.
+func sortTree(n *node) {
+	sort.SliceStable(n.children, func(i, j int) bool {
+		if n.root {
+			return n.children[i].name == RecoveryDir && n.children[j].name != RecoveryDir
+		}
+		return strings.ToLower(n.children[i].name) < strings.ToLower(n.children[j].name)
+	})
+	for _, child := range n.children {
+		sortTree(child)
+	}
+}
+
+// fitSize returns a disk size in MB that holds the files in n with room for
+// OpenCore's logs and NVRAM, allowing for the largest FAT32 clusters.
+func fitSize(n *node) int64 {
+	const cluster = 32 << 10
+	var bytes func(n *node) int64
+	bytes = func(n *node) int64 {
+		total := (n.size + cluster - 1) / cluster * cluster
+		if n.dir {
+			total += cluster
+		}
+		for _, child := range n.children {
+			total += bytes(child)
+		}
+		return total
+	}
+	total := bytes(n)
+	return (total+total/50)>>20 + 64
+}
+
+// checkLabel checks label can be used as a FAT32 volume label and returns
+// it in upper case.
+func checkLabel(label string) (string, error) {
+	if label == "" {
+		label = DefaultLabel
+	}
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		return "", fmt.Errorf("volume label %s is longer than 11 characters", label)
+	}
+	for _, c := range label {
+		if c != ' ' && !shortValid(c) {
+			return "", fmt.Errorf("volume label %s cannot contain %q", label, c)
+		}
+	}
+	return label, nil
+}
+
+// Create writes the disk described by opts to output as a raw image. It is
+// written to output.part first and renamed once complete.
+func Create(output string, opts Options) error {
+	label, err := checkLabel(opts.Label)
+	if err != nil {
+		return err
+	}
+	root, err := tree(opts)
+	if err != nil {
+		return err
+	}
+	sizeMB := int64(opts.SizeMB)
+	if sizeMB == 0 {
+		sizeMB = fitSize(root)
+	} else if sizeMB < MinSizeMB {
+		return fmt.Errorf("the disk must be at least %d MB for FAT32", MinSizeMB)
+	}
+	sectors := sizeMB << 20 / sectorSize
+
+	part := output + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+
+	// Truncate leaves the free space as a hole in the file where it can
+	err = f.Truncate(sectors * sectorSize)
+	if err == nil {
+		err = writeGPT(f, sectors)
+	}
+	if err == nil {
+		err = formatFAT(f, partitionLBA, partitionEnd(sectors)-partitionLBA+1, label, root, time.Now())
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, errNoSpace) {
+		return fmt.Errorf("%v but the disk is %d MB", err, sizeMB)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(part, output)
+}
@@ -0,0 +1,362 @@
+package bootdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// writeFiles writes files, mapping slash separated paths to contents, below
+// dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkGPT checks the protective MBR and both GUID partition tables of disk,
+// and returns the first and last sector of its partition.
+func checkGPT(t *testing.T, disk []byte) (int64, int64) {
+	t.Helper()
+	sectors := int64(len(disk)) / sectorSize
+	sector := func(lba int64) []byte { return disk[lba*sectorSize : (lba+1)*sectorSize] }
+
+	mbr := sector(0)
+	entry := mbr[446:]
+	if mbr[510] != 0x55 || mbr[511] != 0xaa || entry[4] != 0xee {
+		t.Fatal("no protective MBR")
+	}
+	if start, size := binary.LittleEndian.Uint32(entry[8:]), binary.LittleEndian.Uint32(entry[12:]); start != 1 || int64(size) != sectors-1 {
+		t.Errorf("protective MBR covers %d sectors from %d, want %d from 1", size, start, sectors-1)
+	}
+	for i := 1; i < 4; i++ {
+		if !bytes.Equal(mbr[446+16*i:446+16*(i+1)], make([]byte, 16)) {
+			t.Errorf("MBR partition %d is not empty", i+1)
+		}
+	}
+
+	var first, last int64
+	for _, lba := range []int64{1, sectors - 1} {
+		h := sector(lba)
+		if string(h[:8]) != "EFI PART" {
+			t.Fatalf("no GPT header at sector %d", lba)
+		}
+		header := bytes.Clone(h[:gptHeaderSize])
+		binary.LittleEndian.PutUint32(header[16:], 0)
+		if crc32.ChecksumIEEE(header) != binary.LittleEndian.Uint32(h[16:]) {
+			t.Errorf("GPT header at sector %d has the wrong CRC", lba)
+		}
+		myLBA, altLBA := int64(binary.LittleEndian.Uint64(h[24:])), int64(binary.LittleEndian.Uint64(h[32:]))
+		if myLBA != lba || altLBA != sectors-lba {
+			t.Errorf("GPT header at sector %d says it is at %d with its backup at %d", lba, myLBA, altLBA)
+		}
+
+		entriesLBA := int64(binary.LittleEndian.Uint64(h[72:]))
+		count, size := binary.LittleEndian.Uint32(h[80:]), binary.LittleEndian.Uint32(h[84:])
+		entries := disk[entriesLBA*sectorSize : entriesLBA*sectorSize+int64(count*size)]
+		if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(h[88:]) {
+			t.Errorf("GPT entries at sector %d have the wrong CRC", entriesLBA)
+		}
+		if !bytes.Equal(entries[:16], espType[:]) {
+			t.Errorf("GPT entries at sector %d do not start with an EFI system partition", entriesLBA)
+		}
+		first, last = int64(binary.LittleEndian.Uint64(entries[32:])), int64(binary.LittleEndian.Uint64(entries[40:]))
+		firstUsable, lastUsable := int64(binary.LittleEndian.Uint64(h[40:])), int64(binary.LittleEndian.Uint64(h[48:]))
+		if first < firstUsable || last > lastUsable || (last-first+1)%8 != 0 {
+			t.Errorf("partition from %d to %d is not 4K sectors between %d and %d", first, last, firstUsable, lastUsable)
+		}
+	}
+	return first, last
+}
+
+// fatVolume reads back a FAT32 file system.
+type fatVolume struct {
+	t           *testing.T
+	data        []byte // the partition
+	clusterSize int
+	dataStart   int
+	fat         []byte
+}
+
+// readFAT checks the boot sector and that both FATs match, and returns the
+// volume and its label.
+func readFAT(t *testing.T, data []byte) (*fatVolume, string) {
+	t.Helper()
+	boot := data[:sectorSize]
+	if string(boot[82:90]) != "FAT32   " || boot[510] != 0x55 || boot[511] != 0xaa {
+		t.Fatal("no FAT32 boot sector")
+	}
+	if !bytes.Equal(boot, data[6*sectorSize:7*sectorSize]) {
+		t.Error("backup boot sector differs")
+	}
+	if sectors := binary.LittleEndian.Uint32(boot[32:]); int(sectors)*sectorSize != len(data) {
+		t.Errorf("boot sector gives %d sectors, the partition has %d", sectors, len(data)/sectorSize)
+	}
+	reserved := int(binary.LittleEndian.Uint16(boot[14:]))
+	fatSize := int(binary.LittleEndian.Uint32(boot[36:])) * sectorSize
+	fat1 := data[reserved*sectorSize : reserved*sectorSize+fatSize]
+	fat2 := data[reserved*sectorSize+fatSize : reserved*sectorSize+2*fatSize]
+	if !bytes.Equal(fat1, fat2) {
+		t.Error("the two FATs differ")
+	}
+	v := &fatVolume{
+		t:           t,
+		data:        data,
+		clusterSize: int(boot[13]) * sectorSize,
+		dataStart:   reserved*sectorSize + 2*fatSize,
+		fat:         fat1,
+	}
+	return v, strings.TrimRight(string(boot[71:82]), " ")
+}
+
+// read returns the data in the cluster chain starting at cluster.
+func (v *fatVolume) read(cluster uint32) []byte {
+	var data []byte
+	for cluster != 0 && cluster < 0x0ffffff8 {
+		if len(data) > len(v.data) {
+			v.t.Fatal("cluster chain loops")
+		}
+		offset := v.dataStart + int(cluster-2)*v.clusterSize
+		data = append(data, v.data[offset:offset+v.clusterSize]...)
+		cluster = binary.LittleEndian.Uint32(v.fat[4*cluster:]) & 0x0fffffff
+	}
+	return data
+}
+
+// walk adds the files below the folder at cluster to files, by path, with
+// folders ending in /. It returns the volume label if the folder has one.
+func (v *fatVolume) walk(cluster uint32, path string, files map[string]string) string {
+	v.t.Helper()
+	var label string
+	var long []uint16
+	var sums []byte
+	next := 0 // number of the long name entry expected next
+	dir := v.read(cluster)
+	for i := 0; i+32 <= len(dir) && dir[i] != 0; i += 32 {
+		e := dir[i : i+32]
+		if e[11] == attrLongName {
+			seq := int(e[0] &^ 0x40)
+			if e[0]&0x40 != 0 {
+				long, sums, next = make([]uint16, seq*lfnChars), nil, seq
+			}
+			if seq != next || seq == 0 {
+				v.t.Errorf("%s: long name entry %d out of order", path, seq)
+				return label
+			}
+			for j := 0; j < lfnChars; j++ {
+				at := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}[j]
+				long[(seq-1)*lfnChars+j] = binary.LittleEndian.Uint16(e[at:])
+			}
+			sums = append(sums, e[13])
+			next--
+			continue
+		}
+
+		var short [11]byte
+		copy(short[:], e)
+		name := strings.TrimRight(string(short[:8]), " ")
+		if ext := strings.TrimRight(string(short[8:]), " "); ext != "" {
+			name += "." + ext
+		}
+		if long != nil {
+			if next != 0 {
+				v.t.Errorf("%s: long name of %s is missing entries", path, name)
+			}
+			for _, sum := range sums {
+				if sum != shortChecksum(short) {
+					v.t.Errorf("%s: long name of %s has the wrong checksum", path, name)
+				}
+			}
+			if end := slices.Index(long, 0); end >= 0 {
+				long = long[:end]
+			}
+			name = string(utf16.Decode(long))
+			long = nil
+		}
+
+		first := uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+		switch {
+		case e[11]&attrVolumeID != 0:
+			label = strings.TrimRight(string(short[:]), " ")
+		case name == "." || name == "..":
+		case e[11]&attrDirectory != 0:
+			files[path+name+"/"] = ""
+			sub := v.read(first)
+			if dot := binary.LittleEndian.Uint16(sub[26:]); string(sub[:11]) != ".          " || uint32(dot) != first {
+				v.t.Errorf("%s%s has no . entry pointing at itself", path, name)
+			}
+			v.walk(first, path+name+"/", files)
+		default:
+			size := int(binary.LittleEndian.Uint32(e[28:]))
+			files[path+name] = string(v.read(first)[:size])
+		}
+	}
+	return label
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	image := make([]byte, 300000) // many clusters
+	rand.New(rand.NewSource(1)).Read(image)
+	efi := map[string]string{
+		"EFI/BOOT/BOOTx64.efi":                          "boot loader",
+		"EFI/OC/OpenCore.efi":                           "opencore",
+		"EFI/OC/config.plist":                           "<plist/>",
+		"EFI/OC/Drivers/OpenRuntime.efi":                "driver",
+		"EFI/OC/Resources/Label/Long file name one.txt": "1",
+		"EFI/OC/Resources/Label/Long file name two.txt": "2",
+		"EFI/OC/Resources/Label/Thirteen_char":          "exactly one long name entry",
+		"EFI/OC/Resources/Label/Résumé été.plist":       "accents",
+		"EFI/OC/Resources/Label/EMPTY.TXT":              "",
+	}
+	writeFiles(t, filepath.Join(dir, "OpenCore"), efi)
+	writeFiles(t, dir, map[string]string{"image.dmg": string(image), "image.chunklist": "chunklist"})
+
+	output := filepath.Join(dir, "boot.img")
+	opts := Options{
+		DMG:       filepath.Join(dir, "image.dmg"),
+		Chunklist: filepath.Join(dir, "image.chunklist"),
+		EFIDir:    filepath.Join(dir, "OpenCore"),
+		Label:     "OpenCore",
+	}
+	if err := Create(output, opts); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	disk, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, last := checkGPT(t, disk)
+	v, label := readFAT(t, disk[first*sectorSize:(last+1)*sectorSize])
+	files := map[string]string{}
+	if volume := v.walk(2, "", files); volume != "OPENCORE" || label != "OPENCORE" {
+		t.Errorf("volume labels are %q and %q, want OPENCORE", volume, label)
+	}
+
+	want := map[string]string{
+		RecoveryDir + "/":                 "",
+		RecoveryDir + "/" + ImageName:     string(image),
+		RecoveryDir + "/" + ChunklistName: "chunklist",
+		"EFI/":                            "",
+		"EFI/BOOT/":                       "",
+		"EFI/OC/":                         "",
+		"EFI/OC/Drivers/":                 "",
+		"EFI/OC/Resources/":               "",
+		"EFI/OC/Resources/Label/":         "",
+	}
+	for name, data := range efi {
+		want[name] = data
+	}
+	var missing, extra []string
+	for name, data := range want {
+		got, ok := files[name]
+		if !ok {
+			missing = append(missing, name)
+		} else if got != data {
+			t.Errorf("%s holds %d bytes that differ from the %d written", name, len(got), len(data))
+		}
+	}
+	for name := range files {
+		if _, ok := want[name]; !ok {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	if len(missing) != 0 || len(extra) != 0 {
+		t.Errorf("volume is missing %v and has extra %v", missing, extra)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"image.dmg":      "image",
+		"same/EFI/a.efi": "lower case",
+		"same/EFI/A.EFI": "upper case",
+		"file/EFI":       "not a folder",
+		"big.dmg":        "",
+	})
+	dmg := filepath.Join(dir, "image.dmg")
+	// A sparse image too big for the smallest disk
+	if err := os.Truncate(filepath.Join(dir, "big.dmg"), (MinSizeMB+1)<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		want string // part of the error
+	}{
+		{"long label", Options{DMG: dmg, Label: "TWELVE CHARS"}, "longer than 11"},
+		{"label character", Options{DMG: dmg, Label: "EFI.BOOT"}, "cannot contain"},
+		{"small disk", Options{DMG: dmg, SizeMB: MinSizeMB - 1}, "at least"},
+		{"files do not fit", Options{DMG: filepath.Join(dir, "big.dmg"), SizeMB: MinSizeMB}, "not enough space"},
+		{"missing image", Options{DMG: filepath.Join(dir, "missing.dmg")}, "missing.dmg"},
+		{"names differing in case", Options{DMG: dmg, EFIDir: filepath.Join(dir, "same")}, "on the disk twice"},
+		{"EFI folder is a file", Options{DMG: dmg, EFIDir: filepath.Join(dir, "file", "EFI")}, "not a folder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "boot.img")
+			err := Create(output, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Create error %v, want %q", err, tt.want)
+			}
+			if _, err := os.Stat(output); err == nil {
+				t.Error("failed Create left an image")
+			}
+		})
+	}
+}
+
+func TestNewLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		sectors int64
+		want    string // part of the error, empty for none
+	}{
+		{"smallest disk", (MinSizeMB<<20)/sectorSize - partitionLBA - 1 - gptSectors, ""},
+		{"too few clusters", 60000, "too small"},
+		{"one sector per cluster", 532480, ""},
+		{"eight sectors per cluster", 532481, ""},
+		{"too many sectors", 1 << 32, "too big"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newLayout(tt.sectors)
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("newLayout error %v, want %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newLayout: %v", err)
+			}
+			// The FATs must have an entry for every cluster
+			if int64(l.fatSectors)*sectorSize/4 < int64(l.clusters)+2 {
+				t.Errorf("%d FAT sectors cannot hold %d clusters", l.fatSectors, l.clusters)
+			}
+			if end := int64(l.dataStart()) + int64(l.clusters*l.sectorsPerCluster); end > tt.sectors {
+				t.Errorf("clusters end at sector %d past the %d of the partition", end, tt.sectors)
+			}
+		})
+	}
+}
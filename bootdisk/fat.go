@@ -0,0 +1,434 @@
+package bootdisk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FAT32 limits
+const (
+	reservedSectors = 32
+	minClusters     = 65525
+	maxClusters     = 0x0ffffff5
+	maxFileSize     = 1<<32 - 1
+	lfnChars        = 13 // UTF-16 characters in each long name entry
+	endOfChain      = 0x0fffffff
+)
+
+// Directory entry attributes
+const (
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = 0x0f
+)
+
+// fatLayout is where the parts of a FAT32 file system are, in sectors from
+// the start of the partition.
+type fatLayout struct {
+	sectors           uint32
+	sectorsPerCluster uint32
+	fatSectors        uint32
+	clusters          uint32
+}
+
+// newLayout works out the layout of a FAT32 file system filling sectors
+// sectors, with the cluster sizes Microsoft's format uses.
+func newLayout(sectors int64) (fatLayout, error) {
+	if sectors > 0xffffffff {
+		return fatLayout{}, fmt.Errorf("%d MB is too big for FAT32", sectors*sectorSize>>20)
+	}
+	l := fatLayout{sectors: uint32(sectors)}
+	switch {
+	case sectors <= 532480: // 260 MB
+		l.sectorsPerCluster = 1
+	case sectors <= 16777216: // 8 GB
+		l.sectorsPerCluster = 8
+	case sectors <= 33554432: // 16 GB
+		l.sectorsPerCluster = 16
+	case sectors <= 67108864: // 32 GB
+		l.sectorsPerCluster = 32
+	default:
+		l.sectorsPerCluster = 64
+	}
+
+	// From the FAT specification, slightly larger than needed
+	perFAT := (256*l.sectorsPerCluster + 2) / 2
+	l.fatSectors = (l.sectors - reservedSectors + perFAT - 1) / perFAT
+	l.clusters = (l.sectors - l.dataStart()) / l.sectorsPerCluster
+	if l.clusters < minClusters || l.clusters > maxClusters {
+		return fatLayout{}, fmt.Errorf("%d MB is too small for FAT32", sectors*sectorSize>>20)
+	}
+	return l, nil
+}
+
+// dataStart returns the first sector of cluster 2.
+func (l fatLayout) dataStart() uint32 {
+	return reservedSectors + 2*l.fatSectors
+}
+
+// clusterBytes returns the size of a cluster.
+func (l fatLayout) clusterBytes() int64 {
+	return int64(l.sectorsPerCluster) * sectorSize
+}
+
+// clusterOffset returns the offset of cluster c from the partition start.
+func (l fatLayout) clusterOffset(c uint32) int64 {
+	return (int64(l.dataStart()) + int64(c-2)*int64(l.sectorsPerCluster)) * sectorSize
+}
+
+// formatFAT writes a FAT32 file system holding root to the partition of
+// sectors sectors starting at sector start.
+func formatFAT(f *os.File, start, sectors int64, label string, root *node, modTime time.Time) error {
+	l, err := newLayout(sectors)
+	if err != nil {
+		return err
+	}
+	if err := nameEntries(root); err != nil {
+		return err
+	}
+
+	// Clusters are handed out in order, so files are not fragmented
+	next := uint32(2)
+	var allocate func(n *node)
+	allocate = func(n *node) {
+		size := n.size
+		if n.dir {
+			size = int64(n.entryCount()) * 32
+		}
+		n.clusters = uint32((size + l.clusterBytes() - 1) / l.clusterBytes())
+		if n.clusters > 0 {
+			n.cluster = next
+			next += n.clusters
+		}
+		for _, child := range n.children {
+			allocate(child)
+		}
+	}
+	allocate(root)
+	if used := int64(next - 2); used > int64(l.clusters) {
+		return fmt.Errorf("%w, the files need %d MB", errNoSpace, used*l.clusterBytes()>>20)
+	}
+
+	fat := make([]byte, int64(l.fatSectors)*sectorSize)
+	binary.LittleEndian.PutUint32(fat[0:], 0x0ffffff8)
+	binary.LittleEndian.PutUint32(fat[4:], endOfChain)
+	base := start * sectorSize
+
+	var write func(n, parent *node) error
+	write = func(n, parent *node) error {
+		for c := n.cluster; c < n.cluster+n.clusters; c++ {
+			value := uint32(c + 1)
+			if c == n.cluster+n.clusters-1 {
+				value = endOfChain
+			}
+			binary.LittleEndian.PutUint32(fat[4*c:], value)
+		}
+
+		if !n.dir {
+			return copyData(f, n, base+l.clusterOffset(n.cluster))
+		}
+		// The unused entries are zero, which marks the end of the folder
+		data := make([]byte, int64(n.clusters)*l.clusterBytes())
+		copy(data, directory(n, parent, label, modTime))
+		if _, err := f.WriteAt(data, base+l.clusterOffset(n.cluster)); err != nil {
+			return err
+		}
+		for _, child := range n.children {
+			if err := write(child, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write(root, nil); err != nil {
+		return err
+	}
+
+	boot := bootSector(l, start, label, modTime)
+	info := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(info[488:], l.clusters-(next-2))
+	binary.LittleEndian.PutUint32(info[492:], next)
+	binary.LittleEndian.PutUint32(info[508:], 0xaa550000)
+
+	// The boot sector and FSInfo have backups at sector 6
+	writes := []struct {
+		data   []byte
+		sector int64
+	}{
+		{boot, 0},
+		{info, 1},
+		{boot, 6},
+		{info, 7},
+		{fat, reservedSectors},
+		{fat, reservedSectors + int64(l.fatSectors)},
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.data, base+w.sector*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bootSector returns the FAT32 boot sector.
+func bootSector(l fatLayout, hidden int64, label string, modTime time.Time) []byte {
+	b := make([]byte, sectorSize)
+	copy(b[0:], []byte{0xeb, 0x58, 0x90})
+	copy(b[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(b[11:], sectorSize)
+	b[13] = byte(l.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(b[14:], reservedSectors)
+	b[16] = 2    // FATs
+	b[21] = 0xf8 // fixed disk
+	binary.LittleEndian.PutUint16(b[24:], 63)
+	binary.LittleEndian.PutUint16(b[26:], 255)
+	binary.LittleEndian.PutUint32(b[28:], uint32(hidden))
+	binary.LittleEndian.PutUint32(b[32:], l.sectors)
+	binary.LittleEndian.PutUint32(b[36:], l.fatSectors)
+	binary.LittleEndian.PutUint32(b[44:], 2) // root folder cluster
+	binary.LittleEndian.PutUint16(b[48:], 1) // FSInfo sector
+	binary.LittleEndian.PutUint16(b[50:], 6) // backup boot sector
+	b[64] = 0x80
+	b[66] = 0x29
+	binary.LittleEndian.PutUint32(b[67:], uint32(modTime.UnixNano()))
+	copy(b[71:82], padName(label, 11))
+	copy(b[82:], "FAT32   ")
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// copyData copies the file for n to offset.
+func copyData(f *os.File, n *node, offset int64) error {
+	if n.size == 0 {
+		return nil
+	}
+	in, err := os.Open(n.source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := io.CopyN(io.NewOffsetWriter(f, offset), in, n.size); err != nil {
+		return fmt.Errorf("%s: %v", n.source, err)
+	}
+	return nil
+}
+
+// directory returns the entries of the folder n, whose parent is parent or
+// nil for the root folder.
+func directory(n, parent *node, label string, modTime time.Time) []byte {
+	var data []byte
+	if parent == nil {
+		var name [11]byte
+		copy(name[:], padName(label, 11))
+		data = append(data, dirEntry(name, attrVolumeID, 0, 0, modTime)...)
+	} else {
+		var dot, dotdot [11]byte
+		copy(dot[:], padName(".", 11))
+		copy(dotdot[:], padName("..", 11))
+		data = append(data, dirEntry(dot, attrDirectory, n.cluster, 0, modTime)...)
+		// .. points at cluster 0 when the parent is the root folder
+		up := parent.cluster
+		if parent.root {
+			up = 0
+		}
+		data = append(data, dirEntry(dotdot, attrDirectory, up, 0, modTime)...)
+	}
+
+	for _, child := range n.children {
+		if child.long {
+			data = append(data, longEntries(child.name, child.short)...)
+		}
+		attr := byte(attrArchive)
+		if child.dir {
+			attr = attrDirectory
+		}
+		data = append(data, dirEntry(child.short, attr, child.cluster, uint32(child.size), modTime)...)
+	}
+	return data
+}
+
+// dirEntry returns a 32 byte directory entry.
+func dirEntry(name [11]byte, attr byte, cluster, size uint32, modTime time.Time) []byte {
+	e := make([]byte, 32)
+	copy(e, name[:])
+	e[11] = attr
+	date, clock := dosTime(modTime)
+	binary.LittleEndian.PutUint16(e[14:], clock)
+	binary.LittleEndian.PutUint16(e[16:], date)
+	binary.LittleEndian.PutUint16(e[18:], date)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], clock)
+	binary.LittleEndian.PutUint16(e[24:], date)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+// longEntries returns the long name entries for name, last part first as
+// they are stored.
+func longEntries(name string, short [11]byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%lfnChars != 0 {
+		chars = append(chars, 0)
+		for len(chars)%lfnChars != 0 {
+			chars = append(chars, 0xffff)
+		}
+	}
+	sum := shortChecksum(short)
+	count := len(chars) / lfnChars
+
+	var data []byte
+	for i := count; i >= 1; i-- {
+		e := make([]byte, 32)
+		e[0] = byte(i)
+		if i == count {
+			e[0] |= 0x40
+		}
+		e[11] = attrLongName
+		e[13] = sum
+		part := chars[(i-1)*lfnChars : i*lfnChars]
+		for j, c := range part {
+			var at int
+			switch {
+			case j < 5:
+				at = 1 + 2*j
+			case j < 11:
+				at = 14 + 2*(j-5)
+			default:
+				at = 28 + 2*(j-11)
+			}
+			binary.LittleEndian.PutUint16(e[at:], c)
+		}
+		data = append(data, e...)
+	}
+	return data
+}
+
+// shortChecksum is the checksum of a short name stored in its long name
+// entries.
+func shortChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// dosTime returns the FAT date and time of t.
+func dosTime(t time.Time) (date, clock uint16) {
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	clock = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, clock
+}
+
+// padName returns s padded with spaces to n bytes.
+func padName(s string, n int) []byte {
+	b := []byte(strings.Repeat(" ", n))
+	copy(b, s)
+	return b
+}
+
+// nameEntries gives every file and folder below n a unique short name,
+// and a long name entry too when its name is not a plain upper case 8.3
+// name.
+func nameEntries(n *node) error {
+	used := map[[11]byte]bool{}
+	for _, child := range n.children {
+		if len(utf16.Encode([]rune(child.name))) > 255 {
+			return fmt.Errorf("%s: name too long for FAT32", child.name)
+		}
+		if child.size > maxFileSize {
+			return fmt.Errorf("%s is too big for FAT32, the limit is 4 GB", child.source)
+		}
+		child.short, child.long = shortName(child.name, used)
+		used[child.short] = true
+		if err := nameEntries(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shortName returns the 8.3 name stored for name, and whether a long name
+// is needed too, avoiding the names in used.
+func shortName(name string, used map[[11]byte]bool) ([11]byte, bool) {
+	var short [11]byte
+	upper := strings.ToUpper(name)
+	base, ext, _ := cutLast(upper, ".")
+	if valid83(base, ext) {
+		copy(short[:8], padName(base, 8))
+		copy(short[8:], padName(ext, 3))
+		if !used[short] {
+			return short, upper != name
+		}
+	}
+
+	// Windows style BASENA~1.EXT
+	trimmed := strings.TrimLeft(strings.ReplaceAll(upper, " ", ""), ".")
+	base, ext, _ = cutLast(trimmed, ".")
+	base = shortChars(strings.ReplaceAll(base, ".", ""))
+	ext = shortChars(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	for i := 1; ; i++ {
+		tail := fmt.Sprintf("~%d", i)
+		b := base
+		if len(b) > 8-len(tail) {
+			b = b[:8-len(tail)]
+		}
+		copy(short[:8], padName(b+tail, 8))
+		copy(short[8:], padName(ext, 3))
+		if !used[short] {
+			return short, true
+		}
+	}
+}
+
+// cutLast splits s around the last sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// shortValid reports whether c may be used in a short name.
+func shortValid(c rune) bool {
+	return c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("$%'-_@~`!(){}^#&", c)
+}
+
+// shortChars replaces the characters a short name cannot hold with _.
+func shortChars(s string) string {
+	return strings.Map(func(c rune) rune {
+		if shortValid(c) {
+			return c
+		}
+		return '_'
+	}, s)
+}
+
+// valid83 reports whether base and ext already make a short name.
+func valid83(base, ext string) bool {
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 {
+		return false
+	}
+	for _, c := range base + ext {
+		if !shortValid(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package bootdisk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize    = 512
+	gptEntries    = 128
+	gptEntrySize  = 128
+	gptSectors    = gptEntries * gptEntrySize / sectorSize // sectors of partition entries
+	partitionLBA  = 2048                                   // first partition starts at 1 MB
+	espName       = "EFI System Partition"
+	gptHeaderSize = 92
+)
+
+// espType is the EFI system partition type GUID
+// C12A7328-F81F-11D2-BA4B-00A0C93EC93B as stored on disk.
+var espType = [16]byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}
+
+// newGUID returns a random version 4 GUID as stored on disk, where the
+// version is in the high nibble of the little endian third field.
+func newGUID() ([16]byte, error) {
+	var g [16]byte
+	if _, err := rand.Read(g[:]); err != nil {
+		return g, err
+	}
+	g[7] = g[7]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g, nil
+}
+
+// partitionEnd returns the last sector of the single partition on a disk of
+// sectors sectors, leaving room for the backup GPT and keeping the partition
+// a whole number of 4K sectors.
+func partitionEnd(sectors int64) int64 {
+	lastUsable := sectors - 1 - 1 - gptSectors
+	size := (lastUsable - partitionLBA + 1) &^ 7
+	return partitionLBA + size - 1
+}
+
+// writeGPT writes a protective MBR and the primary and backup GUID partition
+// tables for a disk of sectors sectors holding one EFI system partition.
+func writeGPT(f *os.File, sectors int64) error {
+	diskGUID, err := newGUID()
+	if err != nil {
+		return err
+	}
+	partGUID, err := newGUID()
+	if err != nil {
+		return err
+	}
+
+	// Protective MBR covering the whole disk, so older tools leave it alone
+	mbr := make([]byte, sectorSize)
+	entry := mbr[446:]
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = 0xee
+	copy(entry[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	protective := uint64(sectors - 1)
+	if protective > 0xffffffff {
+		protective = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(entry[12:], uint32(protective))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		return err
+	}
+
+	entries := make([]byte, gptSectors*sectorSize)
+	copy(entries[0:], espType[:])
+	copy(entries[16:], partGUID[:])
+	binary.LittleEndian.PutUint64(entries[32:], partitionLBA)
+	binary.LittleEndian.PutUint64(entries[40:], uint64(partitionEnd(sectors)))
+	for i, c := range utf16.Encode([]rune(espName)) {
+		binary.LittleEndian.PutUint16(entries[56+2*i:], c)
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	lastLBA := sectors - 1
+	header := func(myLBA, altLBA, entriesLBA int64) []byte {
+		h := make([]byte, sectorSize)
+		copy(h, "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], gptHeaderSize)
+		binary.LittleEndian.PutUint64(h[24:], uint64(myLBA))
+		binary.LittleEndian.PutUint64(h[32:], uint64(altLBA))
+		binary.LittleEndian.PutUint64(h[40:], 2+gptSectors)
+		binary.LittleEndian.PutUint64(h[48:], uint64(lastLBA-1-gptSectors))
+		copy(h[56:], diskGUID[:])
+		binary.LittleEndian.PutUint64(h[72:], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(h[80:], gptEntries)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:gptHeaderSize]))
+		return h
+	}
+
+	backupEntries := lastLBA - gptSectors
+	writes := []struct {
+		data []byte
+		lba  int64
+	}{
+		{header(1, lastLBA, 2), 1},
+		{entries, 2},
+		{entries, backupEntries},
+		{header(lastLBA, 1, backupEntries), lastLBA},
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.data, w.lba*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,25 +15,19 @@ cp -v CHANGELOG.md ./build
 cp -v LICENSE ./build
 cp -v recovery_urls.txt ./build
 cp -v boards.json ./build
+cp -v catalog/catalog.json ./build
 
 # AMD64 builds
 echo "Building AMD64 versions..."
-GOOS=windows GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/windows/amd64/recoveryOS.exe recoveryOS.go
-GOOS=linux GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/linux/amd64/recoveryOS recoveryOS.go
-GOOS=darwin GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/macos/amd64/recoveryOS recoveryOS.go
-GOOS=windows GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/windows/amd64/macrecovery.exe macrecovery.go
-GOOS=linux GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/linux/amd64/macrecovery macrecovery.go
-GOOS=darwin GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/macos/amd64/macrecovery macrecovery.go
-
+GOOS=windows GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/windows/amd64/recoveryOS.exe ./cmd/recoveryOS
+GOOS=linux GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/linux/amd64/recoveryOS ./cmd/recoveryOS
+GOOS=darwin GOARCH=amd64 go build -ldflags="$LDFLAGS" -o build/macos/amd64/recoveryOS ./cmd/recoveryOS
 
 # ARM64 builds
 echo "Building ARM64 versions..."
-GOOS=windows GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/windows/arm64/recoveryOS.exe recoveryOS.go
-GOOS=linux GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/linux/arm64/recoveryOS recoveryOS.go
-GOOS=darwin GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/macos/arm64/recoveryOS recoveryOS.go
-GOOS=windows GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/windows/arm64/macrecovery.exe macrecovery.go
-GOOS=linux GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/linux/arm64/macrecovery macrecovery.go
-GOOS=darwin GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/macos/arm64/macrecovery macrecovery.go
+GOOS=windows GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/windows/arm64/recoveryOS.exe ./cmd/recoveryOS
+GOOS=linux GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/linux/arm64/recoveryOS ./cmd/recoveryOS
+GOOS=darwin GOARCH=arm64 go build -ldflags="$LDFLAGS" -o build/macos/arm64/recoveryOS ./cmd/recoveryOS
 
 # Build distribution zip file
 rm -vf ./dist/recoveryOS-$VERSION.zip
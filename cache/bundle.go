@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/chunklist"
+	"github.com/DrDonk/recoveryOS/client"
+)
+
+// A bundle is a tar archive of cache entries for moving them to a machine
+// with no internet access. The manifest comes first, followed by a directory
+// for each entry named as in the cache.
+const (
+	ManifestName  = "manifest.json"
+	BundleVersion = 1
+)
+
+// Manifest lists the entries in a bundle.
+type Manifest struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Entries []BundleEntry `json:"entries"`
+}
+
+// BundleEntry describes one entry in a bundle and the check made on it
+// before it was exported.
+type BundleEntry struct {
+	Product  string    `json:"product"`
+	Digest   string    `json:"chunklist_sha256"`
+	Size     int64     `json:"image_size"`
+	Chunks   int       `json:"chunks"`
+	Verified time.Time `json:"verified"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// Export verifies entries and writes them to w as a bundle. progress is
+// called with the product being checked and the chunks done so far.
+func (c *Cache) Export(ctx context.Context, w io.Writer, entries []Entry, jobs int, progress func(product string, done, total int)) (*Manifest, error) {
+	if progress == nil {
+		progress = func(string, int, int) {}
+	}
+
+	manifest := &Manifest{Version: BundleVersion, Created: time.Now().UTC()}
+	for _, e := range entries {
+		cl, err := chunklist.ReadFile(e.Chunklist())
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Verify(ctx, e, jobs, func(done, total int) { progress(e.Product, done, total) }); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Product, err)
+		}
+		m, err := e.Metadata()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Product, err)
+		}
+		// Entries stored by older versions may still hold the tokens
+		m.ImageInfo = client.PublicInfo(m.ImageInfo)
+		manifest.Entries = append(manifest.Entries, BundleEntry{
+			Product:  e.Product,
+			Digest:   e.Digest,
+			Size:     cl.Size(),
+			Chunks:   len(cl.Chunks),
+			Verified: time.Now().UTC(),
+			Metadata: m,
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(w)
+	header := &tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.Created}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		for _, name := range []string{ChunklistName, DMGName} {
+			if err := addFile(ctx, tw, filepath.Join(e.Path, name), filepath.Base(e.Path)+"/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return manifest, tw.Close()
+}
+
+// addFile copies the file at src into the archive as name.
+func addFile(ctx context.Context, tw *tar.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, readerFunc(func(p []byte) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return f.Read(p)
+	}))
+	return err
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// Import reads a bundle from r, verifies every image against its chunklist
+// and the manifest and adds them to the cache. Nothing is added unless every
+// entry checks out. progress is called with the product being checked and
+// the chunks done so far.
+func (c *Cache) Import(ctx context.Context, r io.Reader, jobs int, progress func(product string, done, total int)) ([]Entry, error) {
+	if progress == nil {
+		progress = func(string, int, int) {}
+	}
+
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("not a bundle: %v", err)
+	}
+	if header.Name != ManifestName {
+		return nil, fmt.Errorf("not a bundle: %s does not come first", ManifestName)
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(io.LimitReader(tr, 16<<20)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", ManifestName, err)
+	}
+	if manifest.Version != BundleVersion {
+		return nil, fmt.Errorf("bundle version %d is not supported", manifest.Version)
+	}
+
+	// Only the files the manifest names are unpacked
+	wanted := make(map[string]bool)
+	for _, be := range manifest.Entries {
+		digest, err := hex.DecodeString(be.Digest)
+		if err != nil || len(digest) != 32 {
+			return nil, fmt.Errorf("%s: bad chunklist digest %q", be.Product, be.Digest)
+		}
+		dir := key(be.Product, [32]byte(digest))
+		wanted[dir+"/"+ChunklistName] = true
+		wanted[dir+"/"+DMGName] = true
+	}
+
+	tmpDir, err := os.MkdirTemp(c.Dir, "import-*.part")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := path.Clean(header.Name)
+		if !wanted[name] || header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected file %s in bundle", header.Name)
+		}
+		delete(wanted, name)
+
+		dst := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(out, readerFunc(func(p []byte) (int, error) {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			return tr.Read(p)
+		}))
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("%s is missing from the bundle", name)
+	}
+
+	// Check everything before adding anything
+	type checked struct {
+		be BundleEntry
+		cl *chunklist.Chunklist
+	}
+	var good []checked
+	for _, be := range manifest.Entries {
+		digest, _ := hex.DecodeString(be.Digest)
+		dir := filepath.Join(tmpDir, key(be.Product, [32]byte(digest)))
+		cl, err := chunklist.ReadFile(filepath.Join(dir, ChunklistName))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", be.Product, err)
+		}
+		if hex.EncodeToString(cl.Digest[:]) != be.Digest {
+			return nil, fmt.Errorf("%s: chunklist does not match the manifest", be.Product)
+		}
+		err = cl.Verify(ctx, filepath.Join(dir, DMGName), jobs, func(done, total int) { progress(be.Product, done, total) })
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", be.Product, err)
+		}
+		good = append(good, checked{be, cl})
+	}
+
+	var entries []Entry
+	for _, g := range good {
+		dir := filepath.Join(tmpDir, key(g.be.Product, g.cl.Digest))
+		e, err := c.Store(g.be.Product, g.cl, filepath.Join(dir, DMGName), filepath.Join(dir, ChunklistName))
+		if err != nil {
+			return entries, err
+		}
+		if m := g.be.Metadata; m != nil && (m.ImageInfo != nil || len(m.Requests) > 0) {
+			if err := c.AddMetadata(e, m.ImageInfo, m.Requests...); err != nil {
+				return entries, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
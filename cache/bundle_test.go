@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// tarFile is one member of a bundle.
+type tarFile struct {
+	name string
+	data []byte
+}
+
+// readBundle returns the members of a bundle in order.
+func readBundle(t *testing.T, bundle []byte) []tarFile {
+	t.Helper()
+	var files []tarFile
+	tr := tar.NewReader(bytes.NewReader(bundle))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, tarFile{header.Name, data})
+	}
+}
+
+// writeBundle packs files into a bundle in order.
+func writeBundle(t *testing.T, files []tarFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// exportTwo exports a cache holding two images, one with metadata, and
+// returns the bundle.
+func exportTwo(t *testing.T) []byte {
+	t.Helper()
+	c, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	for i, product := range []string{"041-11111", "041-22222"} {
+		dmg, cnk, cl := imageFiles(t, bytes.Repeat([]byte(product), 100+i))
+		e, err := c.Store(product, cl, dmg, cnk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	req := Request{BoardID: "Mac-827FAC58A8FDFA22", MLB: "00000000000000000", OSType: "latest"}
+	if err := c.AddMetadata(entries[0], map[string]string{"AP": "041-11111"}, req); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := c.Export(context.Background(), &buf, entries, 2, nil); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// checkEmpty fails unless a failed import left nothing in c.
+func checkEmpty(t *testing.T, c *Cache) {
+	t.Helper()
+	files, err := os.ReadDir(c.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		t.Errorf("failed import left %s in the cache", f.Name())
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	bundle := exportTwo(t)
+
+	files := readBundle(t, bundle)
+	if len(files) != 5 || files[0].name != ManifestName {
+		t.Fatalf("bundle holds %d files starting with %s, want %s and two entries", len(files), files[0].name, ManifestName)
+	}
+
+	c, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := c.Import(context.Background(), bytes.NewReader(bundle), 2, nil)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if len(imported) != 2 {
+		t.Fatalf("imported %d entries, want 2", len(imported))
+	}
+	for _, e := range imported {
+		data, err := os.ReadFile(e.DMG())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(e.Product)) {
+			t.Errorf("%s has the wrong image", e.Product)
+		}
+		if err := c.Verify(context.Background(), e, 1, nil); err != nil {
+			t.Errorf("%s: %v", e.Product, err)
+		}
+	}
+
+	m, err := imported[0].Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported[0].Product != "041-11111" || len(m.Requests) != 1 || m.ImageInfo["AP"] != "041-11111" {
+		t.Errorf("metadata of %s is %+v, want the exported request and info", imported[0].Product, m)
+	}
+}
+
+func TestImportBadBundles(t *testing.T) {
+	files := readBundle(t, exportTwo(t))
+
+	// change returns a copy of the bundle's files after f has changed them
+	change := func(f func([]tarFile) []tarFile) []byte {
+		copied := append([]tarFile(nil), files...)
+		for i := range copied {
+			copied[i].data = bytes.Clone(copied[i].data)
+		}
+		return writeBundle(t, f(copied))
+	}
+
+	tests := []struct {
+		name   string
+		bundle []byte
+		want   string
+	}{
+		{"manifest not first", change(func(f []tarFile) []tarFile {
+			f[0], f[1] = f[1], f[0]
+			return f
+		}), "does not come first"},
+		{"extra file", change(func(f []tarFile) []tarFile {
+			return append(f, tarFile{"notes.txt", []byte("hello")})
+		}), "unexpected file notes.txt"},
+		{"path outside the bundle", change(func(f []tarFile) []tarFile {
+			return append(f, tarFile{"../escape", []byte("hello")})
+		}), "unexpected file ../escape"},
+		{"file twice", change(func(f []tarFile) []tarFile {
+			return append(f, f[1])
+		}), "unexpected file"},
+		{"missing file", change(func(f []tarFile) []tarFile {
+			return f[:len(f)-1]
+		}), "missing from the bundle"},
+		{"corrupt image", change(func(f []tarFile) []tarFile {
+			for i := range f {
+				if strings.HasSuffix(f[i].name, "/"+DMGName) {
+					f[i].data[10] ^= 0xff
+					break
+				}
+			}
+			return f
+		}), "hash mismatch"},
+		{"not a tar", []byte("not a bundle at all"), "not a bundle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.Import(context.Background(), bytes.NewReader(tt.bundle), 2, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Import error %v, want %q", err, tt.want)
+			}
+			checkEmpty(t, c)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Package cache keeps verified recovery images so that later downloads of the
+// same image can be linked or copied instead of fetched again.
+//
+// Entries are keyed by the product ID and the digest of the chunklist, so a
+// product that Apple rebuilds gets a new entry. Each entry is a directory
+// holding image.dmg and image.chunklist, with info.json recording the
+// requests Apple answered with it, and its modification time records when it
+// was last used.
+//
+// Prune limits follow one rule: a negative age or size, NoLimit, is not
+// applied, while zero removes everything the other limit allows.
+package cache
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/chunklist"
+)
+
+// NoLimit turns off the age or size limit of Prune.
+const NoLimit = -1
+
+// File names inside an entry
+const (
+	DMGName       = "image.dmg"
+	ChunklistName = "image.chunklist"
+)
+
+// Cache is a cache directory.
+type Cache struct {
+	Dir string
+}
+
+// DefaultDir returns the cache directory used when none is given, recoveryOS
+// in the user's cache directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "recoveryOS"), nil
+}
+
+// New opens the cache in dir, creating it if needed.
+func New(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// Open opens the cache in dir, or in DefaultDir if dir is empty.
+func Open(dir string) (*Cache, error) {
+	if dir == "" {
+		var err error
+		if dir, err = DefaultDir(); err != nil {
+			return nil, err
+		}
+	}
+	return New(dir)
+}
+
+// Entry is one cached image.
+type Entry struct {
+	Product  string
+	Digest   string // hex SHA-256 of the chunklist
+	Path     string // entry directory
+	Size     int64  // size of the image and chunklist
+	LastUsed time.Time
+}
+
+// DMG returns the path of the cached image.
+func (e Entry) DMG() string {
+	return filepath.Join(e.Path, DMGName)
+}
+
+// Chunklist returns the path of the cached chunklist.
+func (e Entry) Chunklist() string {
+	return filepath.Join(e.Path, ChunklistName)
+}
+
+// key returns the entry directory name for a product and chunklist digest.
+// Anything that is not safe in a file name is replaced in the product ID.
+func key(product string, digest [32]byte) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, product)
+	return safe + "_" + hex.EncodeToString(digest[:])
+}
+
+// readEntry loads the entry in directory name, checking both files are there.
+func (c *Cache) readEntry(name string) (Entry, error) {
+	path := filepath.Join(c.Dir, name)
+	sep := strings.LastIndexByte(name, '_')
+	if sep < 0 || len(name)-sep-1 != 64 {
+		return Entry{}, fmt.Errorf("%s is not a cache entry", path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{Product: name[:sep], Digest: name[sep+1:], Path: path, LastUsed: info.ModTime()}
+	for _, file := range []string{e.DMG(), e.Chunklist()} {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			return Entry{}, err
+		}
+		e.Size += fileInfo.Size()
+	}
+	return e, nil
+}
+
+// Lookup finds the entry for a product and chunklist digest and marks it as
+// used. The image is only used if it is the size the chunklist expects.
+func (c *Cache) Lookup(product string, cl *chunklist.Chunklist) (Entry, bool) {
+	e, err := c.readEntry(key(product, cl.Digest))
+	if err != nil {
+		return Entry{}, false
+	}
+
+	info, err := os.Stat(e.DMG())
+	if err != nil || info.Size() != cl.Size() {
+		return Entry{}, false
+	}
+
+	now := time.Now()
+	os.Chtimes(e.Path, now, now)
+	e.LastUsed = now
+	return e, true
+}
+
+// Store adds a verified image and its chunklist to the cache, linking them
+// when the cache is on the same file system and copying them otherwise.
+func (c *Cache) Store(product string, cl *chunklist.Chunklist, dmgPath, cnkPath string) (Entry, error) {
+	name := key(product, cl.Digest)
+	if e, err := c.readEntry(name); err == nil {
+		return e, nil
+	}
+
+	// Fill a temporary directory so a half stored entry is never seen
+	tmpDir, err := os.MkdirTemp(c.Dir, name+".part")
+	if err != nil {
+		return Entry{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := LinkOrCopy(cnkPath, filepath.Join(tmpDir, ChunklistName)); err != nil {
+		return Entry{}, err
+	}
+	if err := LinkOrCopy(dmgPath, filepath.Join(tmpDir, DMGName)); err != nil {
+		return Entry{}, err
+	}
+
+	// Entries are named by their content, so when another download stored
+	// the same image first its entry is used. Only an incomplete entry left
+	// behind by an earlier failure is replaced.
+	path := filepath.Join(c.Dir, name)
+	if err := os.Rename(tmpDir, path); err != nil {
+		if e, readErr := c.readEntry(name); readErr == nil {
+			return e, nil
+		}
+		if _, statErr := os.Stat(path); statErr != nil {
+			return Entry{}, err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return Entry{}, err
+		}
+		if err := os.Rename(tmpDir, path); err != nil {
+			return Entry{}, err
+		}
+	}
+	return c.readEntry(name)
+}
+
+// List returns the entries, most recently used first.
+func (c *Cache) List() ([]Entry, error) {
+	dirs, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.Contains(dir.Name(), ".part") {
+			continue
+		}
+		e, err := c.readEntry(dir.Name())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Verify checks a cached image against its chunklist.
+func (c *Cache) Verify(ctx context.Context, e Entry, jobs int, progress func(done, total int)) error {
+	cl, err := chunklist.ReadFile(e.Chunklist())
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(cl.Digest[:]) != e.Digest {
+		return fmt.Errorf("chunklist does not match the entry name")
+	}
+	return cl.Verify(ctx, e.DMG(), jobs, progress)
+}
+
+// Remove deletes an entry.
+func (c *Cache) Remove(e Entry) error {
+	return os.RemoveAll(e.Path)
+}
+
+// Prune removes entries not used within maxAge, then the least recently used
+// entries until they are no larger than maxSize, and then prunes the chunk
+// store to the same age and the space the entries leave. Either limit can be
+// NoLimit. It returns the entries removed and the number and size of the
+// chunks removed.
+func (c *Cache) Prune(maxAge time.Duration, maxSize int64) ([]Entry, int, int64, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	var removed []Entry
+	cutoff := time.Now().Add(-maxAge)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		tooOld := maxAge >= 0 && e.LastUsed.Before(cutoff)
+		tooBig := maxSize >= 0 && total > maxSize
+		if !tooOld && !tooBig {
+			continue
+		}
+		if err := c.Remove(e); err != nil {
+			return removed, 0, 0, err
+		}
+		total -= e.Size
+		removed = append(removed, e)
+	}
+
+	chunkSize := int64(NoLimit)
+	if maxSize >= 0 {
+		chunkSize = max(maxSize-total, 0)
+	}
+	chunks, freed, err := c.Chunks().Prune(maxAge, chunkSize)
+	return removed, chunks, freed, err
+}
+
+// LinkOrCopy makes dst a hard link to src, or a copy if linking fails. An
+// existing dst is replaced.
+func LinkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
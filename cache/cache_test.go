@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/chunklist"
+	"github.com/DrDonk/recoveryOS/client"
+)
+
+// testFiles writes an image and chunklist to store, returning their paths and
+// a chunklist whose digest names the entry.
+func testFiles(t *testing.T) (string, string, *chunklist.Chunklist) {
+	t.Helper()
+	dir := t.TempDir()
+	dmg := filepath.Join(dir, "image.dmg")
+	cnk := filepath.Join(dir, "image.chunklist")
+	if err := os.WriteFile(dmg, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cnk, []byte("chunklist"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cl := &chunklist.Chunklist{}
+	cl.Digest[0] = 1
+	return dmg, cnk, cl
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	c, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmg, cnk, cl := testFiles(t)
+
+	// Every download of the same image gets the complete entry, whichever
+	// stored it first, and no store takes away an entry another returned
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			e, err := c.Store("041-12345", cl, dmg, cnk)
+			if err == nil {
+				_, err = os.Stat(e.DMG())
+			}
+			errs[i] = err
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Store %d: %v", i, err)
+		}
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Size != int64(len("image")+len("chunklist")) {
+		t.Fatalf("cache holds %+v, want one complete entry", entries)
+	}
+}
+
+func TestStoreReplacesIncomplete(t *testing.T) {
+	c, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmg, cnk, cl := testFiles(t)
+
+	// An entry missing its image, as left by an earlier failure
+	path := filepath.Join(c.Dir, key("041-12345", cl.Digest))
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, ChunklistName), []byte("chunklist"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := c.Store("041-12345", cl, dmg, cnk)
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if _, err := os.Stat(e.DMG()); err != nil {
+		t.Errorf("incomplete entry was not replaced: %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	putChunks := func(t *testing.T, c *Cache, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			data := []byte{byte(i), 1, 2, 3}
+			if err := c.Chunks().Put(chunklist.Chunk{Size: 4, Hash: sha256.Sum256(data)}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	entrySize := int64(len("image") + len("chunklist"))
+
+	tests := []struct {
+		name          string
+		maxAge        time.Duration
+		maxSize       int64
+		entries, kept int // entries and chunks left
+	}{
+		{"no limits", NoLimit, NoLimit, 1, 3},
+		{"recent", time.Hour, NoLimit, 1, 3},
+		{"age zero", 0, NoLimit, 0, 0},
+		{"size zero", NoLimit, 0, 0, 0},
+		{"room for the entry only", NoLimit, entrySize, 1, 0},
+		{"room for two chunks", NoLimit, entrySize + 8, 1, 2},
+		{"large", NoLimit, 1 << 30, 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			dmg, cnk, cl := testFiles(t)
+			if _, err := c.Store("041-12345", cl, dmg, cnk); err != nil {
+				t.Fatal(err)
+			}
+			putChunks(t, c, 3)
+			// Give everything a last use in the past, so an age of zero
+			// catches it
+			past := time.Now().Add(-time.Minute)
+			filepath.Walk(c.Dir, func(path string, _ os.FileInfo, _ error) error {
+				return os.Chtimes(path, past, past)
+			})
+
+			if _, _, _, err := c.Prune(tt.maxAge, tt.maxSize); err != nil {
+				t.Fatalf("Prune: %v", err)
+			}
+			entries, err := c.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks, _, err := c.Chunks().Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.entries || chunks != tt.kept {
+				t.Errorf("left %d entries and %d chunks, want %d and %d", len(entries), chunks, tt.entries, tt.kept)
+			}
+		})
+	}
+}
+
+// realFiles writes an image and a chunklist for it that Verify accepts.
+func realFiles(t *testing.T) (string, string, *chunklist.Chunklist) {
+	t.Helper()
+	return imageFiles(t, []byte("a small recovery image"))
+}
+
+// imageFiles writes data as an image with a chunklist for it.
+func imageFiles(t *testing.T, data []byte) (string, string, *chunklist.Chunklist) {
+	t.Helper()
+	cl := &chunklist.Chunklist{Chunks: []chunklist.Chunk{{Size: uint32(len(data)), Hash: sha256.Sum256(data)}}}
+	cl.Header = chunklist.Header{
+		Magic:           [4]byte{'C', 'N', 'K', 'L'},
+		HeaderSize:      36,
+		FileVersion:     1,
+		ChunkMethod:     1,
+		SignatureMethod: chunklist.SignatureSHA256,
+		ChunkCount:      1,
+		ChunkOffset:     36,
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, cl.Header)
+	binary.Write(&buf, binary.LittleEndian, cl.Chunks)
+	cl.Digest = sha256.Sum256(buf.Bytes())
+	buf.Write(cl.Digest[:])
+
+	dir := t.TempDir()
+	dmg := filepath.Join(dir, "image.dmg")
+	cnk := filepath.Join(dir, "image.chunklist")
+	if err := os.WriteFile(dmg, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cnk, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dmg, cnk, cl
+}
+
+func TestMetadataWithoutTokens(t *testing.T) {
+	c, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmg, cnk, cl := realFiles(t)
+	e, err := c.Store("041-12345", cl, dmg, cnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := map[string]string{
+		client.InfoProduct:   "041-12345",
+		client.InfoImageLink: "http://oscdn.apple.com/image.dmg",
+		client.InfoImageSess: "image-token",
+		client.InfoSignLink:  "http://oscdn.apple.com/image.chunklist",
+		client.InfoSignHash:  "digest",
+		client.InfoSignSess:  "chunklist-token",
+	}
+	checkInfo := func(t *testing.T, where string, got map[string]string) {
+		t.Helper()
+		if got[client.InfoImageSess] != "" || got[client.InfoSignSess] != "" {
+			t.Errorf("%s keeps the asset tokens: %v", where, got)
+		}
+		if got[client.InfoProduct] == "" || got[client.InfoImageLink] == "" || got[client.InfoSignHash] == "" {
+			t.Errorf("%s lost the product, links or digest: %v", where, got)
+		}
+	}
+
+	if err := c.AddMetadata(e, info); err != nil {
+		t.Fatal(err)
+	}
+	m, err := e.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInfo(t, "info.json", m.ImageInfo)
+
+	// An entry written before tokens were removed is cleaned when exported
+	data, _ := json.Marshal(Metadata{ImageInfo: info})
+	if err := os.WriteFile(e.Info(), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := c.Export(context.Background(), io.Discard, []Entry{e}, 1, nil)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	checkInfo(t, "bundle", manifest.Entries[0].Metadata.ImageInfo)
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/chunklist"
+)
+
+// ChunkStore keeps image chunks by their SHA-256 hash so that chunks shared
+// by different images are only downloaded once. Chunks are stored in
+// subdirectories named after the first two hex digits of the hash, and the
+// modification time of each file records when it was last used.
+type ChunkStore struct {
+	Dir string
+}
+
+// Chunks returns the chunk store kept inside the cache.
+func (c *Cache) Chunks() *ChunkStore {
+	return &ChunkStore{Dir: filepath.Join(c.Dir, "chunks")}
+}
+
+func (s *ChunkStore) path(hash [32]byte) string {
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(s.Dir, name[:2], name)
+}
+
+// Has reports whether the store has a chunk.
+func (s *ChunkStore) Has(chunk chunklist.Chunk) bool {
+	info, err := os.Stat(s.path(chunk.Hash))
+	return err == nil && info.Size() == int64(chunk.Size)
+}
+
+// Read returns a chunk, reusing buf when it is big enough, and checks its
+// hash. A chunk that fails the check is removed.
+func (s *ChunkStore) Read(chunk chunklist.Chunk, buf []byte) ([]byte, error) {
+	path := s.path(chunk.Hash)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if uint32(cap(buf)) < chunk.Size {
+		buf = make([]byte, chunk.Size)
+	}
+	buf = buf[:chunk.Size]
+	if _, err := io.ReadFull(file, buf); err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(buf) != chunk.Hash {
+		os.Remove(path)
+		return nil, fmt.Errorf("stored chunk %x is corrupt", chunk.Hash[:8])
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return buf, nil
+}
+
+// Put adds a chunk whose hash has already been checked.
+func (s *ChunkStore) Put(chunk chunklist.Chunk, data []byte) error {
+	path := s.path(chunk.Hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".part-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// AddImage splits a verified image into its chunks and stores any that are
+// missing.
+func (s *ChunkStore) AddImage(dmgPath string, cl *chunklist.Chunklist) error {
+	file, err := os.Open(dmgPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var buf []byte
+	for i, chunk := range cl.Chunks {
+		if uint32(cap(buf)) < chunk.Size {
+			buf = make([]byte, chunk.Size)
+		}
+		buf = buf[:chunk.Size]
+		if _, err := io.ReadFull(file, buf); err != nil {
+			return err
+		}
+		if s.Has(chunk) {
+			continue
+		}
+		if sha256.Sum256(buf) != chunk.Hash {
+			return fmt.Errorf("invalid chunk %d: hash mismatch", i+1)
+		}
+		if err := s.Put(chunk, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type storedChunk struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+func (s *ChunkStore) list() ([]storedChunk, error) {
+	var chunks []storedChunk
+	err := filepath.WalkDir(s.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, storedChunk{path, info.Size(), info.ModTime()})
+		return nil
+	})
+	return chunks, err
+}
+
+// Size returns the number of chunks stored and their total size.
+func (s *ChunkStore) Size() (int, int64, error) {
+	chunks, err := s.list()
+	var total int64
+	for _, chunk := range chunks {
+		total += chunk.size
+	}
+	return len(chunks), total, err
+}
+
+// Prune removes chunks not used within maxAge, then the least recently used
+// chunks until the store is no larger than maxSize. Either limit can be
+// NoLimit. It returns the number of chunks removed and the space freed.
+func (s *ChunkStore) Prune(maxAge time.Duration, maxSize int64) (int, int64, error) {
+	chunks, err := s.list()
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].lastUsed.Before(chunks[j].lastUsed)
+	})
+
+	var total int64
+	for _, chunk := range chunks {
+		total += chunk.size
+	}
+
+	removed := 0
+	var freed int64
+	cutoff := time.Now().Add(-maxAge)
+	for _, chunk := range chunks {
+		tooOld := maxAge >= 0 && chunk.lastUsed.Before(cutoff)
+		tooBig := maxSize >= 0 && total-freed > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.Remove(chunk.path); err != nil {
+			return removed, freed, err
+		}
+		removed++
+		freed += chunk.size
+	}
+
+	return removed, freed, nil
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/client"
+)
+
+// InfoName is the file in an entry recording how the image was found.
+const InfoName = "info.json"
+
+// Request is a query to Apple that was answered with an entry's image.
+type Request struct {
+	BoardID     string `json:"board_id"`
+	MLB         string `json:"mlb"`
+	OSType      string `json:"os_type"`
+	Diagnostics bool   `json:"diagnostics,omitempty"`
+}
+
+// Metadata is what is known about where an entry came from.
+type Metadata struct {
+	ImageInfo map[string]string `json:"image_info,omitempty"`
+	Requests  []Request         `json:"requests,omitempty"`
+}
+
+// Info returns the path of the entry's metadata.
+func (e Entry) Info() string {
+	return filepath.Join(e.Path, InfoName)
+}
+
+// Metadata reads the entry's metadata. Entries stored without any have an
+// empty Metadata.
+func (e Entry) Metadata() (*Metadata, error) {
+	data, err := os.ReadFile(e.Info())
+	if os.IsNotExist(err) {
+		return &Metadata{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// AddMetadata records Apple's answer for an entry, without its asset tokens,
+// and the requests that were given it. A nil info keeps the answer already
+// recorded.
+func (c *Cache) AddMetadata(e Entry, info map[string]string, requests ...Request) error {
+	m, err := e.Metadata()
+	if err != nil {
+		m = &Metadata{}
+	}
+	if info != nil {
+		m.ImageInfo = client.PublicInfo(info)
+	}
+	for _, req := range requests {
+		known := false
+		for _, seen := range m.Requests {
+			known = known || seen == req
+		}
+		if !known {
+			m.Requests = append(m.Requests, req)
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	part := e.Info() + ".part"
+	if err := os.WriteFile(part, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(part, e.Info()); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return nil
+}
+
+// Find returns the most recently used entry that was the answer for a board
+// and OS type, so it can be used without asking Apple. The MLB is not
+// compared. The entry is marked as used.
+func (c *Cache) Find(boardID, osType string, diagnostics bool) (Entry, *Metadata, bool) {
+	entries, err := c.List()
+	if err != nil {
+		return Entry{}, nil, false
+	}
+
+	for _, e := range entries {
+		m, err := e.Metadata()
+		if err != nil {
+			continue
+		}
+		for _, req := range m.Requests {
+			if req.BoardID == boardID && req.OSType == osType && req.Diagnostics == diagnostics {
+				now := time.Now()
+				os.Chtimes(e.Path, now, now)
+				e.LastUsed = now
+				return e, m, true
+			}
+		}
+	}
+	return Entry{}, nil, false
+}
@@ -0,0 +1,229 @@
+// Package catalog holds the tables that map Macs and recovery products to
+// macOS versions: the Mac model list, the product table, boards.json and the
+// macOS version catalog used by recoveryOS.
+//
+// The models, products and versions are built in, and the products and
+// versions can be replaced with files so that new releases can be handled
+// without a rebuild.
+package catalog
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DrDonk/recoveryOS/mlb"
+)
+
+// Model links a Mac model identifier to its board ID, EEEE code and the
+// range of macOS versions it supports.
+type Model struct {
+	Model   string `json:"model"`
+	BoardID string `json:"board_id"`
+	Code    string `json:"eeee,omitempty"`
+	Name    string `json:"name"`
+	MinOS   string `json:"min_os,omitempty"`
+	MaxOS   string `json:"max_os,omitempty"`
+}
+
+//go:embed models.json
+var modelsJSON []byte
+
+// Models returns the built in Mac model list.
+func Models() ([]Model, error) {
+	var models []Model
+	if err := json.Unmarshal(modelsJSON, &models); err != nil {
+		return nil, fmt.Errorf("invalid model catalog: %v", err)
+	}
+	return models, nil
+}
+
+// FindModel looks up a model identifier such as MacBookPro16,1, ignoring
+// case. Models with several board IDs return the first one.
+func FindModel(model string) (Model, error) {
+	models, err := Models()
+	if err != nil {
+		return Model{}, err
+	}
+	for _, m := range models {
+		if strings.EqualFold(m.Model, model) {
+			return m, nil
+		}
+	}
+	return Model{}, fmt.Errorf("unknown model %s", model)
+}
+
+//go:embed products.json
+var productsJSON []byte
+
+// Products reads the table mapping recovery product IDs, such as 041-12345,
+// to macOS versions. An empty path uses the built in table.
+func Products(path string) (map[string]string, error) {
+	data := productsJSON
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	products := make(map[string]string)
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("invalid product table: %v", err)
+	}
+	return products, nil
+}
+
+// WriteProducts saves a product table to path. The file is written under a
+// temporary name first so a failure leaves the old one intact.
+func WriteProducts(path string, products map[string]string) error {
+	data, err := json.MarshalIndent(products, "", " ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".part"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// BoardLatest is the value used in boards.json for boards that get the
+// newest macOS.
+const BoardLatest = "latest"
+
+// Boards is the board list from boards.json, mapping board IDs to the
+// newest macOS version they support. Order keeps the order of the file so an
+// updated file only differs where versions changed.
+type Boards struct {
+	Order    []string
+	Versions map[string]string
+}
+
+// ReadBoards reads a boards.json file.
+func ReadBoards(path string) (*Boards, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("%s is not a JSON object", path)
+	}
+
+	boards := &Boards{Versions: make(map[string]string)}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		board, _ := tok.(string)
+		var version string
+		if err := dec.Decode(&version); err != nil {
+			return nil, fmt.Errorf("invalid entry for %s: %v", board, err)
+		}
+		if _, ok := boards.Versions[board]; !ok {
+			boards.Order = append(boards.Order, board)
+		}
+		boards.Versions[board] = version
+	}
+
+	return boards, nil
+}
+
+// Write saves the board list to path in the boards.json layout. The file is
+// written under a temporary name first so a failure leaves the old one intact.
+func (b *Boards) Write(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for i, board := range b.Order {
+		key, _ := json.Marshal(board)
+		value, _ := json.Marshal(b.Versions[board])
+		buf.WriteString(fmt.Sprintf(" %s: %s", key, value))
+		if i < len(b.Order)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+
+	tmpPath := path + ".part"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// OSVersion is one entry of the macOS version catalog.
+type OSVersion struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	BoardID     string `json:"board_id"`
+	MLB         string `json:"mlb,omitempty"`
+	OSType      string `json:"os_type,omitempty"`
+	Diagnostics bool   `json:"diagnostics,omitempty"`
+	Legacy      bool   `json:"legacy,omitempty"`
+	Notes       string `json:"notes,omitempty"`
+}
+
+// Basename is the lower case name without spaces used for file names and
+// to look the version up.
+func (v OSVersion) Basename() string {
+	return strings.ToLower(strings.ReplaceAll(v.Name, " ", ""))
+}
+
+// The built in catalog, replaced with a file when Apple ships a release
+// before recoveryOS is updated
+//
+//go:embed catalog.json
+var catalogJSON []byte
+
+// LoadVersions reads the macOS version catalog from path, or the built in one
+// if path is empty, and fills in the default MLB and os-type.
+func LoadVersions(path string) ([]OSVersion, error) {
+	data := catalogJSON
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var versions []OSVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("invalid catalog: %v", err)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("catalog has no macOS versions")
+	}
+
+	for i := range versions {
+		v := &versions[i]
+		if v.Name == "" || v.BoardID == "" {
+			return nil, fmt.Errorf("catalog entry %d needs a name and board_id", i+1)
+		}
+		if v.MLB == "" {
+			v.MLB = mlb.Zero
+		}
+		if v.OSType == "" {
+			v.OSType = "latest"
+		}
+	}
+
+	return versions, nil
+}
+
+// FindVersion looks up a version by name, ignoring case and spaces.
+func FindVersion(versions []OSVersion, name string) (OSVersion, bool) {
+	name = strings.ToLower(strings.ReplaceAll(name, " ", ""))
+	for _, v := range versions {
+		if v.Basename() == name {
+			return v, true
+		}
+	}
+	return OSVersion{}, false
+}
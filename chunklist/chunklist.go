@@ -0,0 +1,271 @@
+// Package chunklist reads Apple chunklist (CNKL) files and checks recovery
+// images against them.
+//
+// A chunklist splits an image into chunks and records the size and SHA-256
+// hash of each. The list itself is either signed with Apple's EFI ROM key or
+// followed by its own SHA-256 digest.
+package chunklist
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Signature methods found in Header.SignatureMethod
+const (
+	SignatureRSA    = 1
+	SignatureSHA256 = 2
+)
+
+// AppleEFIROMPublicKey1 is the RSA modulus Apple signs chunklists with.
+var AppleEFIROMPublicKey1 *big.Int
+
+func init() {
+	AppleEFIROMPublicKey1, _ = new(big.Int).SetString("C3E748CAD9CD384329E10E25A91E43E1A762FF529ADE578C935BDDF9B13F2179D4855E6FC89E9E29CA12517D17DFA1EDCE0BEBF0EA7B461FFE61D94E2BDF72C196F89ACD3536B644064014DAE25A15DB6BB0852ECBD120916318D1CCDEA3C84C92ED743FC176D0BACA920D3FCF3158AFF731F88CE0623182A8ED67E650515F75745909F07D415F55FC15A35654D118C55A462D37A3ACDA08612F3F3F6571761EFCCBCC299AEE99B3A4FD6212CCFFF5EF37A2C334E871191F7E1C31960E010A54E86FA3F62E6D6905E1CD57732410A3EB0C6B4DEFDABE9F59BF1618758C751CD56CEF851D1C0EAA1C558E37AC108DA9089863D20E2E7E4BF475EC66FE6B3EFDCF", 16)
+}
+
+// Header is the fixed part at the start of a chunklist file.
+type Header struct {
+	Magic           [4]byte
+	HeaderSize      uint32
+	FileVersion     uint8
+	ChunkMethod     uint8
+	SignatureMethod uint8
+	_               uint8
+	ChunkCount      uint64
+	ChunkOffset     uint64
+	SignatureOffset uint64
+}
+
+// Chunk is the size and SHA-256 hash of one piece of the image.
+type Chunk struct {
+	Size uint32
+	Hash [32]byte
+}
+
+// Chunklist is a parsed chunklist. Digest is the SHA-256 hash of the header
+// and chunks, which is what the signature covers.
+type Chunklist struct {
+	Header Header
+	Chunks []Chunk
+	Digest [32]byte
+}
+
+// Read parses a chunklist and checks its signature.
+func Read(r io.Reader) (*Chunklist, error) {
+	hashCtx := sha256.New()
+	tee := io.TeeReader(r, hashCtx)
+
+	cl := &Chunklist{}
+	if err := binary.Read(tee, binary.LittleEndian, &cl.Header); err != nil {
+		return nil, err
+	}
+
+	if string(cl.Header.Magic[:]) != "CNKL" {
+		return nil, fmt.Errorf("invalid magic")
+	}
+
+	for i := uint64(0); i < cl.Header.ChunkCount; i++ {
+		var chunk Chunk
+		if err := binary.Read(tee, binary.LittleEndian, &chunk); err != nil {
+			return nil, err
+		}
+		cl.Chunks = append(cl.Chunks, chunk)
+	}
+
+	copy(cl.Digest[:], hashCtx.Sum(nil))
+
+	switch cl.Header.SignatureMethod {
+	case SignatureRSA:
+		sigBytes := make([]byte, 256)
+		if _, err := io.ReadFull(r, sigBytes); err != nil {
+			return nil, err
+		}
+
+		signature := new(big.Int).SetBytes(reverseBytes(sigBytes))
+		exponent := big.NewInt(0x10001)
+		plaintext := new(big.Int).Exp(signature, exponent, AppleEFIROMPublicKey1)
+
+		// Construct expected plaintext with PKCS#1 padding and digest
+		expected := new(big.Int)
+		expectedStr := "1" + strings.Repeat("f", 404) + "003031300d060960864801650304020105000420" + strings.Repeat("0", 64)
+		expected.SetString(expectedStr, 16)
+		expected.Or(expected, new(big.Int).SetBytes(cl.Digest[:]))
+
+		// Verify signature matches expected plaintext
+		if plaintext.Cmp(expected) != 0 {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	case SignatureSHA256:
+		hashBytes := make([]byte, 32)
+		if _, err := io.ReadFull(r, hashBytes); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hashBytes, cl.Digest[:]) {
+			return nil, fmt.Errorf("chunklist missing digital signature")
+		}
+	}
+
+	return cl, nil
+}
+
+// ReadFile parses and checks the chunklist at path.
+func ReadFile(path string) (*Chunklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Read(file)
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := 0; i < len(b); i++ {
+		r[i] = b[len(b)-1-i]
+	}
+	return r
+}
+
+// Size returns the size of the image the chunklist describes.
+func (cl *Chunklist) Size() int64 {
+	var size int64
+	for _, chunk := range cl.Chunks {
+		size += int64(chunk.Size)
+	}
+	return size
+}
+
+// Offsets returns where each chunk starts in the image.
+func (cl *Chunklist) Offsets() []int64 {
+	offsets := make([]int64, len(cl.Chunks))
+	var offset int64
+	for i, chunk := range cl.Chunks {
+		offsets[i] = offset
+		offset += int64(chunk.Size)
+	}
+	return offsets
+}
+
+// Verify checks the image at path against the chunklist, hashing jobs chunks
+// in parallel. progress, if not nil, is called as each chunk is checked. If
+// several chunks are bad the first one in the file is reported.
+func (cl *Chunklist) Verify(ctx context.Context, path string, jobs int, progress func(done, total int)) error {
+	if progress == nil {
+		progress = func(done, total int) {}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Work out where each chunk starts so they can be hashed independently
+	offsets := cl.Offsets()
+	for i, chunk := range cl.Chunks {
+		cnkSize := int64(chunk.Size)
+		if offsets[i]+cnkSize > stat.Size() {
+			read := stat.Size() - offsets[i]
+			if read < 0 {
+				read = 0
+			}
+			return fmt.Errorf("invalid chunk %d size: expected %d, read %d", i+1, cnkSize, read)
+		}
+	}
+	if stat.Size() > cl.Size() {
+		return fmt.Errorf("invalid image: larger than chunklist")
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type chunkResult struct {
+		index int
+		err   error
+	}
+
+	indexes := make(chan int)
+	results := make(chan chunkResult)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cnkData []byte
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					results <- chunkResult{i, err}
+					continue
+				}
+
+				chunk := cl.Chunks[i]
+				if uint32(cap(cnkData)) < chunk.Size {
+					cnkData = make([]byte, chunk.Size)
+				}
+				cnkData = cnkData[:chunk.Size]
+
+				var err error
+				if _, err = file.ReadAt(cnkData, offsets[i]); err == nil && sha256.Sum256(cnkData) != chunk.Hash {
+					err = fmt.Errorf("invalid chunk %d: hash mismatch", i+1)
+				}
+				results <- chunkResult{i, err}
+			}
+		}()
+	}
+
+	go func() {
+		for i := range cl.Chunks {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Report the first failing chunk in file order, whichever worker found it
+	failed := -1
+	var failErr error
+	done := 0
+	for r := range results {
+		done++
+		if r.err != nil && (failed < 0 || r.index < failed) {
+			failed = r.index
+			failErr = r.err
+		}
+		progress(done, len(cl.Chunks))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return failErr
+}
+
+// VerifyFile reads the chunklist at cnkPath and checks the image at dmgPath
+// against it.
+func VerifyFile(ctx context.Context, dmgPath, cnkPath string, jobs int, progress func(done, total int)) error {
+	cl, err := ReadFile(cnkPath)
+	if err != nil {
+		return err
+	}
+	return cl.Verify(ctx, dmgPath, jobs, progress)
+}
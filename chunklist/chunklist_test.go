@@ -0,0 +1,176 @@
+package chunklist
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testImage returns random image data split into chunks of chunkSize, the
+// last one shorter, and its chunklist.
+func testImage(t *testing.T, size, chunkSize int) ([]byte, *Chunklist) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	cl := &Chunklist{}
+	for off := 0; off < size; off += chunkSize {
+		end := off + chunkSize
+		if end > size {
+			end = size
+		}
+		cl.Chunks = append(cl.Chunks, Chunk{Size: uint32(end - off), Hash: sha256.Sum256(data[off:end])})
+	}
+	cl.Header = Header{
+		Magic:           [4]byte{'C', 'N', 'K', 'L'},
+		HeaderSize:      36,
+		FileVersion:     1,
+		ChunkMethod:     1,
+		SignatureMethod: SignatureSHA256,
+		ChunkCount:      uint64(len(cl.Chunks)),
+		ChunkOffset:     36,
+	}
+	return data, cl
+}
+
+// encode returns the chunklist file for cl, followed by its SHA-256 digest.
+func encode(t *testing.T, cl *Chunklist) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, cl.Header); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, cl.Chunks); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(buf.Bytes())
+	return append(buf.Bytes(), digest[:]...)
+}
+
+func writeFile(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image.dmg")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRead(t *testing.T) {
+	_, cl := testImage(t, 10000, 1024)
+	raw := encode(t, cl)
+
+	got, err := Read(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(got.Chunks) != len(cl.Chunks) || got.Size() != 10000 {
+		t.Errorf("got %d chunks of %d bytes, want %d of 10000", len(got.Chunks), got.Size(), len(cl.Chunks))
+	}
+
+	// A changed chunk hash no longer matches the digest
+	raw[40] ^= 0xff
+	if _, err := Read(bytes.NewReader(raw)); err == nil {
+		t.Error("Read accepted a chunklist with a bad digest")
+	}
+	if _, err := Read(strings.NewReader("XXXX" + string(raw[4:]))); err == nil {
+		t.Error("Read accepted a chunklist with a bad magic")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const chunkSize = 4096
+	data, cl := testImage(t, 20*chunkSize+100, chunkSize)
+
+	corrupt := func(chunks ...int) []byte {
+		bad := bytes.Clone(data)
+		for _, c := range chunks {
+			bad[c*chunkSize+10] ^= 0xff
+		}
+		return bad
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		jobs int
+		want string // part of the error, empty for none
+	}{
+		{"good", data, 4, ""},
+		{"good single job", data, 1, ""},
+		{"no jobs", data, 0, ""},
+		{"corrupt chunk", corrupt(7), 4, "invalid chunk 8: hash mismatch"},
+		{"first of several corrupt chunks", corrupt(15, 3, 18), 8, "invalid chunk 4: hash mismatch"},
+		{"corrupt last chunk", corrupt(20), 4, "invalid chunk 21: hash mismatch"},
+		{"truncated", data[:10*chunkSize+5], 4, "invalid chunk 11 size: expected 4096, read 5"},
+		{"empty", nil, 4, "invalid chunk 1 size: expected 4096, read 0"},
+		{"too long", append(bytes.Clone(data), 0), 4, "larger than chunklist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var done, total int
+			err := cl.Verify(context.Background(), writeFile(t, tt.data), tt.jobs, func(d, n int) {
+				done, total = d, n
+			})
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if done != len(cl.Chunks) || total != len(cl.Chunks) {
+					t.Errorf("progress ended at %d/%d, want %d/%d", done, total, len(cl.Chunks), len(cl.Chunks))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Verify error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyCancel(t *testing.T) {
+	data, cl := testImage(t, 64*1024, 1024)
+	path := writeFile(t, data)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cl.Verify(ctx, path, 4, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Verify with a cancelled context returned %v, want %v", err, context.Canceled)
+	}
+
+	// Cancelling part way through stops with the context's error, not a
+	// chunk error
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err := cl.Verify(ctx, path, 2, func(done, total int) {
+		if done == 5 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Verify cancelled part way returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	data, cl := testImage(t, 5000, 1000)
+	dir := t.TempDir()
+	dmg := filepath.Join(dir, "a.dmg")
+	cnk := filepath.Join(dir, "a.chunklist")
+	if err := os.WriteFile(dmg, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cnk, encode(t, cl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFile(context.Background(), dmg, cnk, 2, nil); err != nil {
+		t.Fatalf("VerifyFile: %v", err)
+	}
+}
@@ -0,0 +1,727 @@
+// Package client talks to Apple's osrecovery server. It opens sessions, asks
+// which recovery image a board should get and downloads the image files.
+//
+// A Client keeps its connections alive between requests and limits how many
+// requests are in flight to each host, so one Client should be shared by
+// everything that talks to the same servers.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultServer is Apple's recovery server.
+	DefaultServer = "http://osrecovery.apple.com"
+
+	// RecentMac is a board ID that gets the newest macOS.
+	RecentMac = "Mac-27AD2F918AE68F61"
+
+	// ID lengths
+	TypeSID = 16
+	TypeK   = 64
+	TypeFG  = 64
+
+	// Info keys
+	InfoProduct   = "AP"
+	InfoImageLink = "AU"
+	InfoImageHash = "AH"
+	InfoImageSess = "AT"
+	InfoSignLink  = "CU"
+	InfoSignHash  = "CH"
+	InfoSignSess  = "CT"
+
+	// PartSuffix marks downloads that have not been verified yet.
+	PartSuffix = ".part"
+)
+
+// InfoRequired lists the keys every image info answer must have.
+var InfoRequired = []string{InfoProduct, InfoImageLink, InfoImageHash, InfoImageSess, InfoSignLink, InfoSignHash, InfoSignSess}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// Config holds the network settings used for every request.
+type Config struct {
+	// Server is the base URL of the recovery server, DefaultServer if empty.
+	Server string
+	// ConnectTimeout limits connecting to a server and the TLS handshake.
+	ConnectTimeout time.Duration
+	// ReadTimeout limits how long a server may go without sending data, zero
+	// for no limit.
+	ReadTimeout time.Duration
+	// Proxy is a proxy URL for every request. When empty HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY are used.
+	Proxy string
+	// UserAgent is sent with every request.
+	UserAgent string
+	// Headers are sent with every request, replacing any set by the client.
+	Headers http.Header
+	// MaxConnsPerHost limits the requests in flight to each host, zero for
+	// no limit.
+	MaxConnsPerHost int
+	// HostLimits overrides MaxConnsPerHost for the named hosts.
+	HostLimits map[string]int
+	// Log, if not nil, receives the session headers for debugging.
+	Log io.Writer
+}
+
+// DefaultConfig returns the settings used by the command line tools.
+func DefaultConfig() Config {
+	return Config{
+		Server:          DefaultServer,
+		ConnectTimeout:  30 * time.Second,
+		ReadTimeout:     60 * time.Second,
+		UserAgent:       "InternetRecovery/1.0",
+		MaxConnsPerHost: 4,
+		HostLimits:      map[string]int{},
+	}
+}
+
+// Client makes requests to the recovery server and its download hosts.
+type Client struct {
+	cfg   Config
+	http  *http.Client
+	slots *hostLimiter
+}
+
+// New returns a Client using cfg. It fails if the proxy is not valid.
+func New(cfg Config) (*Client, error) {
+	if cfg.Server == "" {
+		cfg.Server = DefaultServer
+	}
+	cfg.Server = strings.TrimSuffix(cfg.Server, "/")
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		cfg:   cfg,
+		http:  httpClient,
+		slots: newHostLimiter(cfg.MaxConnsPerHost, cfg.HostLimits),
+	}, nil
+}
+
+var (
+	defaultClient     *Client
+	defaultClientErr  error
+	defaultClientOnce sync.Once
+)
+
+// Default returns a shared Client using DefaultConfig.
+func Default() (*Client, error) {
+	defaultClientOnce.Do(func() {
+		defaultClient, defaultClientErr = New(DefaultConfig())
+	})
+	return defaultClient, defaultClientErr
+}
+
+// Config returns the settings the client was created with.
+func (c *Client) Config() Config {
+	return c.cfg
+}
+
+// HTTPError is returned when a server answers with anything other than 200 OK.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Status)
+}
+
+// hostLimiter caps the number of requests in flight to each host.
+type hostLimiter struct {
+	mu           sync.Mutex
+	defaultLimit int
+	limits       map[string]int
+	slots        map[string]chan struct{}
+}
+
+func newHostLimiter(defaultLimit int, limits map[string]int) *hostLimiter {
+	lower := make(map[string]int, len(limits))
+	for host, limit := range limits {
+		lower[strings.ToLower(host)] = limit
+	}
+	return &hostLimiter{
+		defaultLimit: defaultLimit,
+		limits:       lower,
+		slots:        make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits for a free slot for host and returns the function that
+// releases it. A limit of zero or less means no limit.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	slots, ok := l.slots[host]
+	if !ok {
+		limit, found := l.limits[host]
+		if !found {
+			limit = l.defaultLimit
+		}
+		if limit > 0 {
+			slots = make(chan struct{}, limit)
+		}
+		l.slots[host] = slots
+	}
+	l.mu.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-slots }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// releaseBody gives back the host slot when a streamed response is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+func newHTTPClient(cfg Config) (*http.Client, error) {
+	proxy, err := proxyFunc(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep enough idle connections to serve the busiest host without redialling
+	idle := cfg.MaxConnsPerHost
+	for _, limit := range cfg.HostLimits {
+		if limit > idle {
+			idle = limit
+		}
+	}
+	if idle < 2 {
+		idle = 2
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		MaxIdleConns:          idle * 4,
+		MaxIdleConnsPerHost:   idle,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// ParseProxy accepts http, https, socks5 and socks5h proxy URLs, with optional
+// user:password for authentication. A bare host:port is taken as an HTTP proxy.
+func ParseProxy(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", raw, err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s, use http, https, socks5 or socks5h", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %s: missing host", raw)
+	}
+
+	return proxyURL, nil
+}
+
+// proxyFunc returns the proxy selection for the transport. With no explicit
+// proxy the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are
+// used, otherwise the given proxy is used for every host not in NO_PROXY.
+func proxyFunc(raw string) (func(*http.Request) (*url.URL, error), error) {
+	if raw == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := ParseProxy(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// bypassProxy reports whether host matches the NO_PROXY list. Entries may be
+// "*", a host name (which also matches its subdomains), a leading dot domain,
+// an IP address or a CIDR range. Ports on entries are ignored.
+func bypassProxy(host, noProxy string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entry = strings.TrimPrefix(entry, "*")
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// do sends a request with the client's headers once a slot for the host is
+// free. For raw requests the response is returned unread with the slot held
+// until its body is closed, otherwise the body is read and a non 200 answer
+// becomes an HTTPError.
+func (c *Client) do(ctx context.Context, urlStr string, headers map[string]string, post map[string]string, raw bool) (http.Header, []byte, *http.Response, error) {
+	var req *http.Request
+	var err error
+
+	if post != nil {
+		var parts []string
+		for k, v := range post {
+			parts = append(parts, k+"="+v)
+		}
+		body := strings.Join(parts, "\n")
+		req, err = http.NewRequestWithContext(ctx, "POST", urlStr, strings.NewReader(body))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	}
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if c.cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", c.cfg.UserAgent)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	for k, values := range c.cfg.Headers {
+		req.Header.Del(k)
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+
+	release, err := c.slots.acquire(ctx, req.URL.Hostname())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+
+	if raw {
+		resp.Body = &releaseBody{resp.Body, release}
+		return nil, nil, resp, nil
+	}
+
+	defer release()
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, nil, &HTTPError{resp.StatusCode, resp.Status}
+	}
+
+	return resp.Header, data, nil, nil
+}
+
+// GenerateID returns value, or a random upper case hex string of length n
+// when value is empty.
+func GenerateID(n int, value string) string {
+	if value != "" {
+		return value
+	}
+	const hexDigits = "0123456789ABCDEF"
+	result := make([]byte, n)
+	for i := 0; i < n; i++ {
+		result[i] = hexDigits[rand.Intn(16)]
+	}
+	return string(result)
+}
+
+// Session opens a session with the recovery server and returns the session
+// cookie to pass to ImageInfo.
+func (c *Client) Session(ctx context.Context) (string, error) {
+	respHeaders, _, _, err := c.do(ctx, c.cfg.Server+"/", nil, nil, false)
+	if err != nil {
+		return "", err
+	}
+
+	if c.cfg.Log != nil {
+		fmt.Fprintln(c.cfg.Log, "Session headers:")
+		for k, v := range respHeaders {
+			fmt.Fprintf(c.cfg.Log, "%s: %s\n", k, v)
+		}
+	}
+
+	for k, values := range respHeaders {
+		if strings.ToLower(k) == "set-cookie" {
+			for _, cookie := range values {
+				parts := strings.Split(cookie, "; ")
+				for _, part := range parts {
+					if strings.HasPrefix(part, "session=") {
+						return part, nil
+					}
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no session in headers")
+}
+
+// ImageRequest selects the image ImageInfo asks for.
+type ImageRequest struct {
+	BoardID     string
+	MLB         string
+	OSType      string // "default" or "latest"
+	Diagnostics bool
+	ClientID    string // random if empty
+}
+
+// PublicInfo returns a copy of an ImageInfo answer without the asset tokens,
+// keeping the product, links and hashes. The tokens let anyone fetch the image
+// for the rest of the session, so they are not written to files.
+func PublicInfo(info map[string]string) map[string]string {
+	if info == nil {
+		return nil
+	}
+	public := make(map[string]string, len(info))
+	for k, v := range info {
+		if k != InfoImageSess && k != InfoSignSess {
+			public[k] = v
+		}
+	}
+	return public
+}
+
+// ImageInfo asks the server which image req should get. The answer maps the
+// Info keys to the product ID and the links and tokens for the image and its
+// chunklist.
+func (c *Client) ImageInfo(ctx context.Context, session string, req ImageRequest) (map[string]string, error) {
+	headers := map[string]string{
+		"Cookie":       session,
+		"Content-Type": "text/plain",
+	}
+
+	post := map[string]string{
+		"cid": GenerateID(TypeSID, req.ClientID),
+		"sn":  req.MLB,
+		"bid": req.BoardID,
+		"k":   GenerateID(TypeK, ""),
+		"fg":  GenerateID(TypeFG, ""),
+	}
+
+	var urlStr string
+	if req.Diagnostics {
+		urlStr = c.cfg.Server + "/InstallationPayload/Diagnostics"
+	} else {
+		urlStr = c.cfg.Server + "/InstallationPayload/RecoveryImage"
+		post["os"] = req.OSType
+	}
+
+	_, output, _, err := c.do(ctx, urlStr, headers, post, false)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string)
+	lines := strings.Split(string(output), "\n")
+	for _, line := range lines {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) == 2 {
+			info[parts[0]] = parts[1]
+		}
+	}
+
+	for _, k := range InfoRequired {
+		if _, ok := info[k]; !ok {
+			return nil, fmt.Errorf("missing key %s", k)
+		}
+	}
+
+	return info, nil
+}
+
+// SaveImage downloads urlStr with the asset token into directory under a
+// temporary name ending in PartSuffix and returns that path. An empty
+// filename uses the last part of the URL. progress, if not nil, is called
+// with the final path as data arrives, first with done set to zero. The
+// caller renames the file with CommitImage once it has been verified.
+func (c *Client) SaveImage(ctx context.Context, urlStr, token, filename, directory string, progress func(path string, done, total int64)) (string, error) {
+	if progress == nil {
+		progress = func(string, int64, int64) {}
+	}
+
+	parsedURL, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+
+	headers := map[string]string{
+		"Cookie": "AssetToken=" + token,
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return "", err
+	}
+
+	if filename == "" {
+		filename = filepath.Base(parsedURL.Path)
+	}
+	if strings.Contains(filename, string(os.PathSeparator)) || filename == "" {
+		return "", fmt.Errorf("invalid save path %s", filename)
+	}
+
+	fullPath := filepath.Join(directory, filename)
+	partPath := fullPath + PartSuffix
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	_, _, resp, err := c.do(ctx, urlStr, headers, nil, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Cancel the transfer if no data arrives within the read timeout. It
+	// starts once the server answers, so waiting for a free connection to
+	// the host does not count.
+	watchdog := NewWatchdog(c.cfg.ReadTimeout, cancel)
+	defer watchdog.Stop()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPError{resp.StatusCode, resp.Status}
+	}
+
+	file, err := os.Create(partPath)
+	if err != nil {
+		return "", err
+	}
+
+	progress(fullPath, 0, resp.ContentLength)
+	if err := c.copyWithProgress(ctx, file, resp.Body, fullPath, resp.ContentLength, watchdog, progress); err != nil {
+		file.Close()
+		os.Remove(partPath)
+		if cause := context.Cause(ctx); cause != nil {
+			return "", cause
+		}
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(partPath)
+		return "", err
+	}
+
+	return partPath, nil
+}
+
+func (c *Client) copyWithProgress(ctx context.Context, file *os.File, body io.Reader, name string, totalSize int64, watchdog *Watchdog, progress func(string, int64, int64)) error {
+	var size int64
+	buffer := make([]byte, 1024*1024)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := body.Read(buffer)
+		if n > 0 {
+			watchdog.Reset()
+			if _, werr := file.Write(buffer[:n]); werr != nil {
+				return werr
+			}
+			size += int64(n)
+			progress(name, size, totalSize)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if totalSize > 0 && size != totalSize {
+		return fmt.Errorf("download truncated: expected %d bytes, got %d", totalSize, size)
+	}
+	return nil
+}
+
+// Watchdog cancels a transfer when no data arrives for a while.
+type Watchdog struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// NewWatchdog starts a Watchdog that calls cancel once timeout passes without
+// a Reset. A timeout of zero or less never fires and gives a nil Watchdog,
+// which is safe to use.
+func NewWatchdog(timeout time.Duration, cancel context.CancelCauseFunc) *Watchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	return &Watchdog{
+		timer: time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("no data received for %v", timeout))
+		}),
+		timeout: timeout,
+	}
+}
+
+// Reset restarts the timeout, as data has arrived.
+func (w *Watchdog) Reset() {
+	if w != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// Stop stops the watchdog from firing.
+func (w *Watchdog) Stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// Reader returns a reader that resets the watchdog on every read of r that
+// returns data, so a slow transfer is not cut off while data still flows.
+func (w *Watchdog) Reader(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if n > 0 {
+			w.Reset()
+		}
+		return n, err
+	})
+}
+
+// readerFunc turns a function into an io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// ErrNoRanges is returned by OpenRange when the server sends the whole file
+// instead of the range asked for.
+var ErrNoRanges = errors.New("server does not support byte ranges")
+
+// OpenRange requests bytes start to end inclusive of urlStr with the asset
+// token and returns the body, which the caller must close. The read timeout
+// applies to the request but not to reading the body.
+func (c *Client) OpenRange(ctx context.Context, urlStr, token string, start, end int64) (io.ReadCloser, error) {
+	headers := map[string]string{
+		"Cookie": "AssetToken=" + token,
+		"Range":  fmt.Sprintf("bytes=%d-%d", start, end),
+	}
+
+	_, _, resp, err := c.do(ctx, urlStr, headers, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil, ErrNoRanges
+	default:
+		resp.Body.Close()
+		return nil, &HTTPError{resp.StatusCode, resp.Status}
+	}
+
+	var first int64 = -1
+	fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &first)
+	if first != start {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server sent range %q, asked for %d-%d", resp.Header.Get("Content-Range"), start, end)
+	}
+
+	return resp.Body, nil
+}
+
+// CommitImage moves a verified download from its temporary name into place
+// and returns the final path.
+func CommitImage(partPath string) (string, error) {
+	fullPath := strings.TrimSuffix(partPath, PartSuffix)
+	if err := os.Rename(partPath, fullPath); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
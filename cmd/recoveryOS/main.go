@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/bootdisk"
+	"github.com/DrDonk/recoveryOS/cache"
+	"github.com/DrDonk/recoveryOS/catalog"
+	"github.com/DrDonk/recoveryOS/chunklist"
+	"github.com/DrDonk/recoveryOS/client"
+	"github.com/DrDonk/recoveryOS/macrecovery"
+	"github.com/DrDonk/recoveryOS/manifest"
+	"github.com/DrDonk/recoveryOS/mlb"
+	"github.com/DrDonk/recoveryOS/vm"
+)
+
+// OSVersion is one entry of the OS catalog
+type OSVersion = catalog.OSVersion
+
+var osVersions []OSVersion
+
+// mlbOptions asks for a generated MLB instead of the one in the catalog
+type mlbOptions struct {
+	Code     string
+	Year     int
+	Location string
+}
+
+// Version information - set during build
+var (
+	Version   = "dev"
+	BuildDate = "unknown"
+	Commit    = "unknown"
+)
+
+// buildTool identifies this build in manifests.
+func buildTool() manifest.Tool {
+	return manifest.Tool{Name: "recoveryOS", Version: Version, Commit: Commit, BuildDate: BuildDate}
+}
+
+// writeManifest saves the manifest for the outputs named basename, a .sha256
+// file next to each artifact and, if key is not nil, a signature of the
+// manifest. A manifest that cannot be written is reported but does not fail
+// the run.
+func writeManifest(basename string, m *manifest.Manifest, key ed25519.PrivateKey) {
+	path := manifest.Path(basename)
+	// A signature left by an earlier run would not match the new manifest
+	err := os.Remove(path + manifest.SignatureSuffix)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		err = m.Write(path)
+	}
+	dir := filepath.Dir(path)
+	for _, a := range m.Artifacts {
+		if err == nil {
+			err = manifest.WriteSidecar(filepath.Join(dir, filepath.FromSlash(a.Name)), a.SHA256)
+		}
+	}
+	if err == nil && key != nil {
+		err = manifest.SignFile(path, key)
+	}
+	if err != nil {
+		fmt.Printf("WARNING: Manifest not written (%v)\n", err)
+		return
+	}
+	if key != nil {
+		fmt.Printf("Manifest written and signed to %s\n", path)
+		return
+	}
+	fmt.Printf("Manifest written to %s\n", path)
+}
+
+// readSignKey loads the -sign-key private key, if one was given.
+func readSignKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return manifest.ReadPrivateKey(path)
+}
+
+// converterVersion returns the first line of the converter's version output.
+func converterVersion(converter string) string {
+	out, err := exec.Command(converter, "--version").Output()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line)
+}
+
+// runQemuImg runs qemu-img with args to create output, removing it if that
+// fails, and returns the conversion to record in the manifest.
+func runQemuImg(format, output string, args ...string) (manifest.Conversion, error) {
+	// Check if qemu-img is available
+	qemuImg := "qemu-img"
+	if runtime.GOOS == "windows" {
+		qemuImg = "qemu-img.exe"
+	}
+
+	if _, err := exec.LookPath(qemuImg); err != nil {
+		return manifest.Conversion{}, fmt.Errorf("qemu-img not found. Please install QEMU first.\n" +
+			"Download from: https://www.qemu.org/download/")
+	}
+
+	conversion := manifest.Conversion{
+		Format:           format,
+		Output:           filepath.Base(output),
+		Converter:        "qemu-img",
+		ConverterVersion: converterVersion(qemuImg),
+		Started:          time.Now().UTC(),
+	}
+
+	cmd := exec.Command(qemuImg, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := runChild(cmd)
+	conversion.Finished = time.Now().UTC()
+	if err != nil {
+		// Don't leave a half written disk behind
+		os.Remove(output)
+		conversion.Error = err.Error()
+		return conversion, fmt.Errorf("conversion failed: %v", err)
+	}
+	return conversion, nil
+}
+
+// convert creates a disk in format from the DMG input and records the
+// conversion and the disk in m.
+func convert(format, input, output string, m *manifest.Manifest) error {
+	fmt.Printf("Converting to %s:\n", format)
+
+	conversion, err := runQemuImg(format, output, "convert", "-f", "dmg", "-O", format, input, output, "-p")
+	if conversion.Started.IsZero() {
+		return err
+	}
+	m.Conversions = append(m.Conversions, conversion)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s disk: %s\n", format, output)
+	return m.AddArtifact(output, manifest.KindDisk)
+}
+
+// convertOVA creates an OVA from the DMG input, holding a streamOptimized
+// VMDK and an OVF descriptor for the virtual machine in cfg.
+func convertOVA(input, output string, cfg *vm.Config, m *manifest.Manifest) error {
+	fmt.Println("Converting to ova:")
+	if cfg == nil {
+		return fmt.Errorf("the macOS version of %s is not known, give it with -os", input)
+	}
+
+	stream := output + ".vmdk.part"
+	defer os.Remove(stream)
+	conversion, err := runQemuImg("ova", stream, "convert", "-f", "dmg", "-O", "vmdk", "-o", "subformat=streamOptimized", input, stream, "-p")
+	if conversion.Started.IsZero() {
+		return err
+	}
+	if err == nil {
+		err = vm.OVA(*cfg, stream, output)
+		conversion.Finished = time.Now().UTC()
+		if err != nil {
+			conversion.Error = err.Error()
+		}
+	}
+	conversion.Output = filepath.Base(output)
+	m.Conversions = append(m.Conversions, conversion)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created ova package: %s\n", output)
+	return m.AddArtifact(output, manifest.KindDisk)
+}
+
+// bootDiskFormats are the formats boot-disk can write.
+var bootDiskFormats = []string{"raw", "vmdk", "qcow2"}
+
+// buildBootDisk builds an OpenCore boot disk in format holding basename.dmg
+// and its chunklist, converting it with qemu-img unless it is raw, and
+// records it in m.
+func buildBootDisk(format, basename string, opts bootdisk.Options, m *manifest.Manifest) error {
+	fmt.Printf("Building %s boot disk:\n", format)
+	output := basename + "-boot." + format
+	opts.DMG = basename + ".dmg"
+	if _, err := os.Stat(basename + ".chunklist"); err == nil {
+		opts.Chunklist = basename + ".chunklist"
+	}
+
+	raw := output
+	if format != "raw" {
+		raw = output + ".raw.part"
+		defer os.Remove(raw)
+	}
+	conversion := manifest.Conversion{
+		Format:           format,
+		Output:           filepath.Base(output),
+		Converter:        "recoveryOS",
+		ConverterVersion: Version,
+		Started:          time.Now().UTC(),
+	}
+	err := bootdisk.Create(raw, opts)
+	if err == nil && format != "raw" {
+		// qemu-img makes the final disk so it is recorded as the converter
+		var qemu manifest.Conversion
+		qemu, err = runQemuImg(format, output, "convert", "-f", "raw", "-O", format, raw, output, "-p")
+		if qemu.Converter != "" {
+			conversion.Converter, conversion.ConverterVersion = qemu.Converter, qemu.ConverterVersion
+		}
+	}
+	conversion.Finished = time.Now().UTC()
+	if err != nil {
+		conversion.Error = err.Error()
+	}
+	m.Conversions = append(m.Conversions, conversion)
+	if err != nil {
+		return fmt.Errorf("boot disk not built: %v", err)
+	}
+
+	fmt.Printf("Created %s boot disk: %s\n", format, output)
+	return m.AddArtifact(output, manifest.KindDisk)
+}
+
+// downloadImage fetches and verifies the recovery image for v into the current
+// directory as basename.dmg and basename.chunklist, recording where it came
+// from in m.
+func downloadImage(ctx context.Context, v OSVersion, basename string, generate mlbOptions, diagnostics, offline bool, store *cache.Cache, chunks *cache.ChunkStore, m *manifest.Manifest) error {
+	fmt.Print("Downloading DMG...\n\n")
+
+	opts := macrecovery.Options{
+		BoardID:     v.BoardID,
+		MLB:         v.MLB,
+		OSType:      v.OSType,
+		Diagnostics: diagnostics,
+		OutDir:      ".",
+		Basename:    basename,
+		Cache:       store,
+		Offline:     offline,
+		Chunks:      chunks,
+		Progress:    macrecovery.TerminalProgress(),
+	}
+
+	if generate.Code != "" {
+		generated, err := mlb.Generate(strings.ToUpper(generate.Code), generate.Year, 0, strings.ToUpper(generate.Location))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Generated MLB %s\n", generated)
+		opts.MLB = generated
+	}
+
+	result, err := macrecovery.Download(ctx, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("download interrupted, partial files removed")
+		}
+		return fmt.Errorf("download failed: %v", err)
+	}
+	if result.CacheErr != nil {
+		fmt.Printf("WARNING: Image not added to the cache (%v)\n", result.CacheErr)
+	}
+
+	m.Inputs = manifest.Inputs{OS: v.Name, BoardID: opts.BoardID, MLB: opts.MLB, OSType: opts.OSType, Diagnostics: diagnostics}
+	m.Product = result.Product
+	m.ImageInfo = client.PublicInfo(result.Info)
+	m.Source = "apple"
+	m.Verification = manifest.Verification{Status: manifest.StatusPassed, Time: time.Now().UTC()}
+	if result.Cached {
+		m.Source = "cache"
+		if offline {
+			m.Source = "offline"
+		}
+		m.Verification = manifest.Verification{Status: manifest.StatusCached}
+	}
+
+	cl, err := chunklist.ReadFile(result.ChunklistPath)
+	if err != nil {
+		return err
+	}
+	m.Verification.Chunks = len(cl.Chunks)
+	m.Verification.ChunklistDigest = hex.EncodeToString(cl.Digest[:])
+
+	if err := m.AddArtifact(result.DMGPath, manifest.KindImage); err != nil {
+		return err
+	}
+	return m.AddArtifact(result.ChunklistPath, manifest.KindChunklist)
+}
+
+// runChild runs cmd and passes on Ctrl-C or a termination request, waiting
+// for the child to clean up rather than exiting underneath it.
+func runChild(cmd *exec.Cmd) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case sig := <-signals:
+			if err := cmd.Process.Signal(sig); err != nil {
+				cmd.Process.Kill()
+			}
+		}
+	}
+}
+
+func readInput(prompt string) (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print(prompt)
+	input, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err // Return the error to the caller
+	}
+	return strings.TrimSpace(input), nil
+}
+
+func printBanner() {
+	fmt.Println("\nOC4VM recoveryOS Image Maker")
+	fmt.Println("============================")
+	fmt.Printf("Version %s-%s\n", Version, Commit)
+	fmt.Print("(c) David Parsons 2022-2026\n\n")
+}
+
+// Results from a version menu
+const (
+	menuPicked = iota
+	menuMore
+	menuZero
+	menuEOF
+)
+
+// versionMenu shows versions as a numbered menu, with an optional extra item
+// after them, and returns the version picked or which other choice was made.
+func versionMenu(title string, versions []OSVersion, more, zero string) (OSVersion, int) {
+	fmt.Println(title)
+	for i, v := range versions {
+		fmt.Printf("%d. %s\n", i+1, v.Name)
+	}
+	if more != "" {
+		fmt.Printf("%d. %s\n", len(versions)+1, more)
+	}
+	fmt.Println("")
+	fmt.Printf("0. %s\n", zero)
+
+	for {
+		selection, err := readInput("Input menu number: ")
+		if err != nil {
+			fmt.Println("\nEOF detected. Exiting...")
+			return OSVersion{}, menuEOF
+		}
+
+		if selection == "0" {
+			return OSVersion{}, menuZero
+		}
+		if more != "" && selection == fmt.Sprintf("%d", len(versions)+1) {
+			return OSVersion{}, menuMore
+		}
+
+		// Check numeric selections
+		for i, v := range versions {
+			if selection == fmt.Sprintf("%d", i+1) {
+				return v, menuPicked
+			}
+		}
+
+		fmt.Println("Invalid selection. Please try again.")
+	}
+}
+
+func selectOS() (OSVersion, bool) {
+	var current, legacy []OSVersion
+	for _, v := range osVersions {
+		if v.Legacy {
+			legacy = append(legacy, v)
+		} else {
+			current = append(current, v)
+		}
+	}
+
+	more := ""
+	if len(legacy) > 0 {
+		more = fmt.Sprintf("Older versions (%s to %s)", legacy[0].Name, legacy[len(legacy)-1].Name)
+	}
+
+	for {
+		v, result := versionMenu("Create a recoveryOS virtual image", current, more, "Exit")
+		switch result {
+		case menuPicked:
+			return v, true
+		case menuZero, menuEOF:
+			return OSVersion{}, false
+		}
+
+		v, result = versionMenu("\nCreate a recoveryOS virtual image for an older version", legacy, "", "Back")
+		switch result {
+		case menuPicked:
+			return v, true
+		case menuEOF:
+			return OSVersion{}, false
+		}
+		fmt.Println("")
+	}
+}
+
+// Disk formats in menu order
+var diskFormats = []struct {
+	Format string
+	Name   string
+}{
+	{"vmdk", "VMware VMDK"},
+	{"qcow2", "QEMU QCOW2"},
+	{"vhdx", "Microsoft VHDX"},
+	{"raw", "Raw image"},
+	{"ova", "OVA package"},
+}
+
+// vmOptions selects the virtual machines created around the disks.
+type vmOptions struct {
+	Types       string
+	CPUs        int
+	MemoryMB    int
+	DiskGB      int
+	TemplateDir string
+	OVMFCode    string
+	OVMFVars    string
+	OpenCore    string
+}
+
+// vmTypes are the virtual machines -vm can create.
+// Packer comes last so its template can use the VMware VM.
+var vmTypes = []string{"vmware", "qemu", "libvirt", "vagrant-vmware", "vagrant-libvirt", "packer"}
+
+func (o *vmOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.Types, "vm", "", "Virtual machines to create, a comma separated list of "+strings.Join(vmTypes, ", "))
+	fs.IntVar(&o.CPUs, "cpus", 2, "Number of CPUs for the virtual machines")
+	fs.IntVar(&o.MemoryMB, "memory", 8192, "Memory in MB for the virtual machines")
+	fs.IntVar(&o.DiskGB, "disk-size", 100, "Size in GB of the blank disk macOS is installed on")
+	fs.StringVar(&o.TemplateDir, "templates", "", "Folder of templates replacing the built in virtual machine templates")
+	defaults := vm.DefaultConfig("", OSVersion{})
+	fs.StringVar(&o.OVMFCode, "ovmf-code", defaults.OVMFCode, "OVMF firmware for the qemu, libvirt and packer virtual machines")
+	fs.StringVar(&o.OVMFVars, "ovmf-vars", defaults.OVMFVars, "OVMF variable store for the qemu, libvirt and packer virtual machines")
+	fs.StringVar(&o.OpenCore, "opencore", "", "OpenCore boot disk, raw or qcow2, for the qemu, libvirt and packer virtual machines")
+}
+
+// types returns the virtual machines asked for in the order of vmTypes,
+// checking they are known.
+func (o *vmOptions) types() ([]string, error) {
+	wanted := map[string]bool{}
+	for _, t := range strings.Split(strings.ToLower(o.Types), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		known := false
+		for _, k := range vmTypes {
+			known = known || k == t
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown virtual machine %s, use %s", t, strings.Join(vmTypes, ", "))
+		}
+		wanted[t] = true
+	}
+
+	var types []string
+	for _, t := range vmTypes {
+		if wanted[t] {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// config returns the virtual machine settings for the disks named basename.
+func (o *vmOptions) config(basename string, v OSVersion) *vm.Config {
+	cfg := vm.DefaultConfig(filepath.Base(basename), v)
+	cfg.CPUs = o.CPUs
+	cfg.MemoryMB = o.MemoryMB
+	cfg.DiskGB = o.DiskGB
+	cfg.TemplateDir = o.TemplateDir
+	cfg.OVMFCode = o.OVMFCode
+	cfg.OVMFVars = o.OVMFVars
+	cfg.OpenCore = o.OpenCore
+	return &cfg
+}
+
+// createVMs creates the virtual machines in types for the disks named
+// basename, converting the disk they need first if it is not there yet.
+func createVMs(basename string, types []string, cfg vm.Config, m *manifest.Manifest) error {
+	dir := filepath.Dir(basename)
+
+	for _, t := range types {
+		var files []string
+		switch t {
+		case "vmware":
+			disk, err := neededDisk(basename, "vmdk", m)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Creating VMware virtual machine:")
+			if files, err = vm.VMware(cfg, disk, dir); err != nil {
+				return fmt.Errorf("VMware virtual machine not created: %v", err)
+			}
+		case "qemu":
+			disk, err := neededDisk(basename, "qcow2", m)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Creating QEMU launch script:")
+			if files, err = vm.QEMUScript(cfg, disk, dir); err != nil {
+				return fmt.Errorf("QEMU launch script not created: %v", err)
+			}
+		case "libvirt":
+			disk, err := neededDisk(basename, "qcow2", m)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Creating libvirt domain:")
+			if files, err = vm.Libvirt(cfg, disk, dir); err != nil {
+				return fmt.Errorf("libvirt domain not created: %v", err)
+			}
+		case "vagrant-vmware":
+			disk, err := neededDisk(basename, "vmdk", m)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Creating Vagrant box for VMware:")
+			if files, err = vm.VagrantVMware(cfg, disk, dir); err != nil {
+				return fmt.Errorf("Vagrant box not created: %v", err)
+			}
+		case "vagrant-libvirt":
+			disk, err := neededDisk(basename, "qcow2", m)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Creating Vagrant box for libvirt:")
+			if files, err = vm.VagrantLibvirt(cfg, disk, dir); err != nil {
+				return fmt.Errorf("Vagrant box not created: %v", err)
+			}
+		case "packer":
+			disk, err := neededDisk(basename, "qcow2", m)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Creating Packer template:")
+			if files, err = vm.Packer(cfg, disk, dir); err != nil {
+				return fmt.Errorf("Packer template not created: %v", err)
+			}
+		}
+
+		for _, file := range files {
+			fmt.Printf("Created %s\n", file)
+			name, err := filepath.Rel(dir, file)
+			if err != nil {
+				return err
+			}
+			if err := m.AddArtifactAs(name, file, manifest.KindVM); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// neededDisk returns the disk in format for basename, converting the DMG to
+// it first if it has not been.
+func neededDisk(basename, format string, m *manifest.Manifest) (string, error) {
+	disk := basename + "." + format
+	if _, err := os.Stat(disk); err == nil {
+		return disk, nil
+	}
+	return disk, convert(format, basename+".dmg", disk, m)
+}
+
+// convertFormat converts basename.dmg to one format.
+func convertFormat(format, basename string, cfg *vm.Config, m *manifest.Manifest) error {
+	dmg := fmt.Sprintf("%s.dmg", basename)
+	output := fmt.Sprintf("%s.%s", basename, format)
+	if format == "ova" {
+		return convertOVA(dmg, output, cfg, m)
+	}
+	return convert(format, dmg, output, m)
+}
+
+// convertImages converts the downloaded DMG to one format, or to every format with "all"
+// cfg describes the virtual machine for an OVA and is nil if the macOS
+// version is not known, in which case "all" leaves the OVA out.
+func convertImages(basename, format string, cfg *vm.Config, m *manifest.Manifest) error {
+	if format != "all" {
+		for _, f := range diskFormats {
+			if f.Format == format {
+				return convertFormat(f.Format, basename, cfg, m)
+			}
+		}
+		return fmt.Errorf("unknown format %s", format)
+	}
+
+	var errors []string
+	for _, f := range diskFormats {
+		// An OVA needs the macOS version, which the other formats do not
+		if f.Format == "ova" && cfg == nil {
+			fmt.Printf("Skipping ova, the macOS version of %s.dmg is not known, give it with -os\n", basename)
+			continue
+		}
+		if err := convertFormat(f.Format, basename, cfg, m); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("some conversions failed:\n%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+func selectConversion(basename string, cfg *vm.Config, m *manifest.Manifest) error {
+	fmt.Println("\nConvert the recoveryOS virtual image")
+	for i, f := range diskFormats {
+		fmt.Printf("%d. %s\n", i+1, f.Name)
+	}
+	fmt.Printf("%d. All\n", len(diskFormats)+1)
+	fmt.Println("")
+	fmt.Println("0. Exit")
+
+	for {
+		selection, err := readInput("Input menu number: ")
+		if err != nil {
+			fmt.Println("\nEOF detected. Exiting...")
+			return nil // Exit gracefully on EOF
+		}
+
+		if selection == "0" {
+			return nil
+		}
+		if selection == fmt.Sprintf("%d", len(diskFormats)+1) {
+			return convertImages(basename, "all", cfg, m)
+		}
+		for i, f := range diskFormats {
+			if selection == fmt.Sprintf("%d", i+1) {
+				return convertImages(basename, f.Format, cfg, m)
+			}
+		}
+
+		fmt.Println("Invalid selection. Please try again.")
+	}
+}
+
+// runMake downloads a recoveryOS image and converts it, asking for the
+// version and format unless they are given as flags.
+func runMake(prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [options]\n\nDownload a recoveryOS image and convert it to a virtual disk.\n\nOptions:\n", prog)
+		fs.PrintDefaults()
+	}
+	osName := fs.String("os", "", "macOS version to download, e.g. sonoma (skips the menu)")
+	catalogPath := fs.String("catalog", "", "OS catalog file to use instead of the built in one")
+	diagnostics := fs.Bool("diagnostics", false, "Download the diagnostics image instead of recoveryOS, if the version has one")
+	format := fs.String("format", "", "Disk format to create: vmdk, qcow2, vhdx, raw, ova or all (skips the menu)")
+	var generate mlbOptions
+	fs.StringVar(&generate.Code, "code", "", "EEEE code to generate a valid MLB for instead of using the anonymous MLB")
+	fs.IntVar(&generate.Year, "year", 2019, "Manufacturing year for the generated MLB")
+	fs.StringVar(&generate.Location, "location", "C02", "Manufacturing location for the generated MLB")
+	useCache := fs.Bool("cache", false, "Keep verified images in the download cache and use them instead of downloading again")
+	dedupe := fs.Bool("dedupe", false, "Keep image chunks in the cache and only download the chunks not already there")
+	offline := fs.Bool("offline", false, "Use the image in the download cache without contacting Apple, e.g. after an import")
+	cacheDir := fs.String("cache-dir", "", "Download cache directory (default: recoveryOS in the user cache directory)")
+	signKey := fs.String("sign-key", "", "ed25519 private key to sign the manifest with")
+	var vmOpts vmOptions
+	vmOpts.register(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	printBanner()
+	m := manifest.New(buildTool())
+
+	key, err := readSignKey(*signKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	if osVersions, err = catalog.LoadVersions(*catalogPath); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	// Check the format and VMs before spending time on the download
+	machines, err := vmOpts.types()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	*format = strings.ToLower(*format)
+	if *format != "" && *format != "all" {
+		known := false
+		for _, f := range diskFormats {
+			known = known || f.Format == *format
+		}
+		if !known {
+			fmt.Fprintf(os.Stderr, "ERROR: Unknown format %s, use vmdk, qcow2, vhdx, raw, ova or all\n", *format)
+			return 1
+		}
+	}
+
+	// Select OS version
+	var version OSVersion
+	if *osName != "" {
+		var found bool
+		version, found = catalog.FindVersion(osVersions, *osName)
+		if !found {
+			fmt.Fprintf(os.Stderr, "ERROR: Unknown macOS version %s\n", *osName)
+			return 1
+		}
+	} else {
+		var ok bool
+		version, ok = selectOS()
+		if !ok {
+			fmt.Println("Exiting...")
+			return 0
+		}
+	}
+	basename := version.Basename()
+	if version.Notes != "" {
+		fmt.Printf("%s: %s\n", version.Name, version.Notes)
+	}
+	if *diagnostics {
+		if !version.Diagnostics {
+			fmt.Fprintf(os.Stderr, "ERROR: No diagnostics image is available for %s\n", version.Name)
+			return 1
+		}
+		basename += "-diagnostics"
+	}
+
+	store, chunks, err := macrecovery.OpenCache(*cacheDir, *useCache, *dedupe, *offline)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	// Download in process, stopping cleanly on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = downloadImage(ctx, version, basename, generate, *diagnostics, *offline, store, chunks, m)
+	stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nERROR: %v\n", err)
+		return 1
+	}
+	writeManifest(basename, m, key)
+
+	// Select conversion format
+	cfg := vmOpts.config(basename, version)
+	if *format != "" {
+		err = convertImages(basename, *format, cfg, m)
+	} else {
+		err = selectConversion(basename, cfg, m)
+	}
+	if err == nil && len(machines) > 0 {
+		err = createVMs(basename, machines, *cfg, m)
+	}
+	if len(m.Conversions) > 0 || len(machines) > 0 {
+		writeManifest(basename, m, key)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	fmt.Println("\nDone! Your recoveryOS image is ready.")
+	return 0
+}
+
+// convertManifest loads the manifest written when basename.dmg was
+// downloaded, or starts one for an image recoveryOS did not download.
+func convertManifest(basename string) (*manifest.Manifest, error) {
+	m, err := manifest.Read(manifest.Path(basename))
+	if err == nil {
+		return m, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	m = manifest.New(buildTool())
+	m.Verification.Status = manifest.StatusUnchecked
+	if err := m.AddArtifact(basename+".dmg", manifest.KindImage); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(basename + ".chunklist"); err == nil {
+		if err := m.AddArtifact(basename+".chunklist", manifest.KindChunklist); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// runConvert converts DMG files that have already been downloaded.
+func runConvert(prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	format := fs.String("format", "all", "Disk format to create: vmdk, qcow2, vhdx, raw, ova or all")
+	signKey := fs.String("sign-key", "", "ed25519 private key to sign the manifests with")
+	osName := fs.String("os", "", "macOS version of the images for -vm (default: the version in their manifest)")
+	catalogPath := fs.String("catalog", "", "OS catalog file to use instead of the built in one")
+	var vmOpts vmOptions
+	vmOpts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [options] image.dmg...\n\nConvert downloaded DMG files to virtual disks next to them.\n\nOptions:\n", prog)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: No DMG files given")
+		fs.Usage()
+		return 2
+	}
+	key, err := readSignKey(*signKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	machines, err := vmOpts.types()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	if osVersions, err = catalog.LoadVersions(*catalogPath); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	failed := false
+	for _, dmg := range fs.Args() {
+		basename := strings.TrimSuffix(dmg, ".dmg")
+		m, err := convertManifest(basename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			failed = true
+			continue
+		}
+		// Virtual machines and OVAs need the macOS version
+		var cfg *vm.Config
+		name := *osName
+		if name == "" {
+			name = m.Inputs.OS
+		}
+		if name != "" {
+			version, found := catalog.FindVersion(osVersions, name)
+			if !found {
+				fmt.Fprintf(os.Stderr, "ERROR: Unknown macOS version %s\n", name)
+				failed = true
+				continue
+			}
+			cfg = vmOpts.config(basename, version)
+		}
+
+		err = convertImages(basename, strings.ToLower(*format), cfg, m)
+		if err == nil && len(machines) > 0 {
+			if cfg != nil {
+				err = createVMs(basename, machines, *cfg, m)
+			} else {
+				err = fmt.Errorf("the macOS version of %s is not known, give it with -os", dmg)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			failed = true
+		}
+		if len(m.Conversions) > 0 || len(machines) > 0 {
+			writeManifest(basename, m, key)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runBootDisk builds OpenCore boot disks for DMG files that have already
+// been downloaded.
+func runBootDisk(prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	format := fs.String("format", "raw", "Disk format to create: "+strings.Join(bootDiskFormats, ", "))
+	var opts bootdisk.Options
+	fs.StringVar(&opts.EFIDir, "efi", "", "OpenCore EFI folder to copy to the disk")
+	fs.IntVar(&opts.SizeMB, "size", 0, "Size of the disk in MB (default: fit the files)")
+	fs.StringVar(&opts.Label, "label", bootdisk.DefaultLabel, "Volume label of the EFI partition")
+	signKey := fs.String("sign-key", "", "ed25519 private key to sign the manifests with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [options] image.dmg...\n\nBuild a GPT disk with a FAT32 EFI partition holding each DMG in %s,\nwhich OpenCore can start the recovery image from.\n\nOptions:\n", prog, bootdisk.RecoveryDir)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: No DMG files given")
+		fs.Usage()
+		return 2
+	}
+	known := false
+	for _, f := range bootDiskFormats {
+		known = known || f == strings.ToLower(*format)
+	}
+	if !known {
+		fmt.Fprintf(os.Stderr, "ERROR: Unknown format %s, use %s\n", *format, strings.Join(bootDiskFormats, ", "))
+		return 2
+	}
+	key, err := readSignKey(*signKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	failed := false
+	for _, dmg := range fs.Args() {
+		basename := strings.TrimSuffix(dmg, ".dmg")
+		m, err := convertManifest(basename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			failed = true
+			continue
+		}
+		if err := buildBootDisk(strings.ToLower(*format), basename, opts, m); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			failed = true
+		}
+		if len(m.Conversions) > 0 {
+			writeManifest(basename, m, key)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runVerifyArtifact checks files against their .sha256 files, or for
+// manifests every artifact listed and, with a public key, the signature.
+func runVerifyArtifact(prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	pubKey := fs.String("pub-key", "", "ed25519 public key the manifests must be signed with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [options] file...\n\nCheck images against their manifest or .sha256 file. Give the manifest to check\nits signature and every file it lists.\n\nOptions:\n", prog)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: No files given")
+		fs.Usage()
+		return 2
+	}
+
+	var pub ed25519.PublicKey
+	if *pubKey != "" {
+		var err error
+		if pub, err = manifest.ReadPublicKey(*pubKey); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+	}
+
+	failed := false
+	for _, path := range fs.Args() {
+		if !strings.HasSuffix(path, manifest.Suffix) {
+			if err := manifest.CheckSidecar(path); err != nil {
+				fmt.Printf("FAILED: %v\n", err)
+				failed = true
+				continue
+			}
+			fmt.Printf("OK: %s\n", path)
+			continue
+		}
+
+		if pub != nil {
+			if err := manifest.VerifyFile(path, pub); err != nil {
+				fmt.Printf("FAILED: %v\n", err)
+				failed = true
+				continue
+			}
+			fmt.Printf("OK: %s signature\n", path)
+		} else if _, err := os.Stat(path + manifest.SignatureSuffix); err == nil {
+			fmt.Printf("WARNING: %s is signed but the signature was not checked, give the key with -pub-key\n", path)
+		}
+		m, err := manifest.Read(path)
+		if err != nil {
+			fmt.Printf("FAILED: %v\n", err)
+			failed = true
+			continue
+		}
+		dir := filepath.Dir(path)
+		errs := m.Check(dir)
+		for _, err := range errs {
+			fmt.Printf("FAILED: %v\n", err)
+		}
+		if len(errs) > 0 {
+			failed = true
+			continue
+		}
+		for _, a := range m.Artifacts {
+			fmt.Printf("OK: %s\n", filepath.Join(dir, filepath.FromSlash(a.Name)))
+		}
+	}
+
+	if failed {
+		fmt.Fprintln(os.Stderr, "\nERROR: Verification failed")
+		return 1
+	}
+	return 0
+}
+
+// runGenerateKey creates a key pair for signing manifests.
+func runGenerateKey(prog string, args []string) int {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	name := fs.String("key", "recoveryOS-signing", "Base name of the key files, .key is private and .pub public")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [options]\n\nCreate an ed25519 key pair for signing manifests.\n\nOptions:\n", prog)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	priv, pub := *name+".key", *name+".pub"
+	for _, path := range []string{priv, pub} {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s already exists\n", path)
+			return 1
+		}
+	}
+	if err := manifest.GenerateKey(priv, pub); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Private key written to %s, keep it safe\n", priv)
+	fmt.Printf("Public key written to %s, give this to anyone checking images\n", pub)
+	return 0
+}
+
+// usage lists the commands of the unified executable.
+func usage(prog string) {
+	fmt.Printf("Usage: %s [command] [options]\n\n", prog)
+	fmt.Println("Commands:")
+	fmt.Printf("  %-16s %s\n", "make", "Download a recoveryOS image and convert it, the default")
+	fmt.Printf("  %-16s %s\n", "convert", "Convert downloaded DMG files to virtual disks")
+	fmt.Printf("  %-16s %s\n", "boot-disk", "Build an OpenCore boot disk holding downloaded DMG files")
+	fmt.Printf("  %-16s %s\n", "verify-artifact", "Check images against their manifest or .sha256 file")
+	fmt.Printf("  %-16s %s\n", "generate-key", "Create a key pair for signing manifests")
+	for _, cmd := range macrecovery.Commands() {
+		fmt.Printf("  %-16s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Printf("  %-16s %s\n", "version", "Print the version")
+	fmt.Printf("\nRun '%s <command> -h' for the options of a command.\n", prog)
+	fmt.Println("The macrecovery style -action=<name> options are still accepted.")
+}
+
+// legacyAction reports whether args use the old macrecovery -action flag.
+func legacyAction(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if strings.HasPrefix(arg, "-") && (name == "action" || strings.HasPrefix(name, "action=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// run picks the command from args. With no command the interactive make flow
+// runs, and when the executable is called macrecovery it behaves like the old
+// macrecovery tool.
+func run(prog string, args []string) int {
+	name := strings.ToLower(strings.TrimSuffix(prog, ".exe"))
+	if name == "macrecovery" || legacyAction(args) {
+		return macrecovery.Main(args)
+	}
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" && args[0] != "--help" {
+		return runMake(prog, args)
+	}
+
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		usage(prog)
+		return 0
+	case "version":
+		fmt.Printf("%s %s-%s (%s)\n", prog, Version, Commit, BuildDate)
+		return 0
+	case "make":
+		return runMake(prog+" make", args[1:])
+	case "convert":
+		return runConvert(prog+" convert", args[1:])
+	case "boot-disk":
+		return runBootDisk(prog+" boot-disk", args[1:])
+	case "verify-artifact":
+		return runVerifyArtifact(prog+" verify-artifact", args[1:])
+	case "generate-key":
+		return runGenerateKey(prog+" generate-key", args[1:])
+	}
+
+	cmd, ok := macrecovery.FindCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "ERROR: Unknown command %s\n\n", args[0])
+		usage(prog)
+		return 2
+	}
+	return cmd.Run(prog+" "+cmd.Name, args[1:])
+}
+
+func main() {
+	os.Exit(run(filepath.Base(os.Args[0]), os.Args[1:]))
+}
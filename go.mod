@@ -0,0 +1,3 @@
+module github.com/DrDonk/recoveryOS
+
+go 1.22
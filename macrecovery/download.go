@@ -0,0 +1,486 @@
+package macrecovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/DrDonk/recoveryOS/cache"
+	"github.com/DrDonk/recoveryOS/chunklist"
+	"github.com/DrDonk/recoveryOS/client"
+	"github.com/DrDonk/recoveryOS/mlb"
+)
+
+// EventKind identifies a step of Download.
+type EventKind int
+
+const (
+	// EventImageInfo is sent once the server has named the product to download.
+	EventImageInfo EventKind = iota
+	// EventDownloadStart is sent before each file is downloaded.
+	EventDownloadStart
+	// EventDownloadProgress is sent as each file downloads, Done and Total are bytes.
+	EventDownloadProgress
+	// EventDownloadDone is sent once each file has downloaded.
+	EventDownloadDone
+	// EventVerifyStart is sent before the image is checked against the chunklist.
+	EventVerifyStart
+	// EventVerifyProgress is sent as chunks are checked, Done and Total are chunks.
+	EventVerifyProgress
+	// EventVerifyDone is sent once every chunk has been checked.
+	EventVerifyDone
+	// EventCached is sent when the image is taken from the cache, File is the
+	// cached copy.
+	EventCached
+	// EventChunksReused is sent once an image has been assembled from the chunk
+	// store, Done is the bytes reused and Total the image size.
+	EventChunksReused
+)
+
+// Event reports the progress of Download.
+type Event struct {
+	Kind    EventKind
+	Product string
+	File    string
+	URL     string
+	Done    int64
+	Total   int64
+}
+
+// Options selects the image Download fetches and where it goes. Empty fields
+// take the same defaults as the command line tool.
+type Options struct {
+	Client      *client.Client    // nil uses client.Default
+	Cache       *cache.Cache      // nil downloads every time
+	Offline     bool              // only use images in Cache found for this board before, without asking Apple
+	Chunks      *cache.ChunkStore // nil downloads the whole image
+	BoardID     string
+	MLB         string
+	OSType      string // "default" or "latest"
+	Diagnostics bool
+	OutDir      string
+	Basename    string    // file name without extension, defaults to the server's name
+	Jobs        int       // chunks hashed in parallel during verification
+	Log         io.Writer // if not nil, receives the image info from the server for debugging
+	Progress    func(Event)
+}
+
+// OpenCache opens the cache in dir, or the default one if dir is empty, for
+// the -cache, -dedupe and -offline settings. The cache is returned for
+// useCache or offline and its chunk store for dedupe, both are nil when none
+// are set.
+func OpenCache(dir string, useCache, dedupe, offline bool) (*cache.Cache, *cache.ChunkStore, error) {
+	if !useCache && !dedupe && !offline {
+		return nil, nil, nil
+	}
+	opened, err := cache.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var store *cache.Cache
+	var chunks *cache.ChunkStore
+	if useCache || offline {
+		store = opened
+	}
+	if dedupe {
+		chunks = opened.Chunks()
+	}
+	return store, chunks, nil
+}
+
+// Result describes a downloaded and verified image.
+type Result struct {
+	Product       string
+	DMGPath       string
+	ChunklistPath string
+	Info          map[string]string
+	Cached        bool  // the image came from the cache
+	CacheErr      error // the image downloaded but could not be added to the cache or chunk store
+}
+
+// HTTPError is returned when a server answers with anything other than 200 OK.
+type HTTPError = client.HTTPError
+
+// VerifyError is returned when a downloaded image does not match its chunklist.
+// The downloaded files are removed.
+type VerifyError struct {
+	Path string
+	Err  error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verification of %s failed: %v", e.Path, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Download fetches the recovery image and chunklist for the options, verifies
+// the image and gives the files their final names. Nothing is left behind if
+// it fails or ctx is cancelled.
+func Download(ctx context.Context, opts Options) (*Result, error) {
+	if opts.BoardID == "" {
+		opts.BoardID = RecentMac
+	}
+	if opts.MLB == "" {
+		opts.MLB = MLBZero
+	}
+	if opts.OSType == "" {
+		opts.OSType = "default"
+	}
+	if opts.OutDir == "" {
+		opts.OutDir = "."
+	}
+	if opts.Jobs < 1 {
+		opts.Jobs = runtime.NumCPU()
+	}
+	progress := opts.Progress
+	if progress == nil {
+		progress = func(Event) {}
+	}
+
+	c := opts.Client
+	if c == nil {
+		var err error
+		if c, err = client.Default(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mlb.Validate(opts.MLB); err != nil {
+		return nil, err
+	}
+
+	if opts.Offline {
+		return copyCached(opts, progress)
+	}
+
+	session, err := c.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := c.ImageInfo(ctx, session, client.ImageRequest{
+		BoardID:     opts.BoardID,
+		MLB:         opts.MLB,
+		OSType:      opts.OSType,
+		Diagnostics: opts.Diagnostics,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Log != nil {
+		fmt.Fprintln(opts.Log, info)
+	}
+
+	progress(Event{Kind: EventImageInfo, Product: info[InfoProduct]})
+
+	cnkName := opts.Basename
+	if opts.Basename != "" {
+		cnkName += ".chunklist"
+	}
+	cnkPart, err := saveImage(ctx, c, info[InfoSignLink], info[InfoSignSess], cnkName, opts.OutDir, progress)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(cnkPart)
+
+	dmgName := opts.Basename
+	if opts.Basename != "" {
+		dmgName += ".dmg"
+	} else if link, err := url.Parse(info[InfoImageLink]); err == nil {
+		dmgName = path.Base(link.Path)
+	}
+	dmgPart := filepath.Join(opts.OutDir, dmgName) + PartSuffix
+
+	// The chunklist is small, so it is always fetched to find the cache key
+	// and the chunks
+	var cl *chunklist.Chunklist
+	if opts.Cache != nil || opts.Chunks != nil {
+		if cl, err = chunklist.ReadFile(cnkPart); err != nil {
+			return nil, &VerifyError{Path: cnkPart, Err: err}
+		}
+	}
+
+	result := &Result{Product: info[InfoProduct], Info: info}
+	if entry, ok := lookupCache(opts.Cache, result.Product, cl); ok {
+		progress(Event{Kind: EventCached, Product: result.Product, File: entry.DMG()})
+		if err := cache.LinkOrCopy(entry.DMG(), dmgPart); err != nil {
+			return nil, err
+		}
+		defer os.Remove(dmgPart)
+		result.Cached = true
+	} else {
+		assembled := false
+		if opts.Chunks != nil {
+			err := assembleImage(ctx, c, opts.Chunks, info[InfoImageLink], info[InfoImageSess], cl, dmgPart, progress)
+			if err != nil && !errors.Is(err, client.ErrNoRanges) {
+				return nil, err
+			}
+			assembled = err == nil
+		}
+		if !assembled {
+			if dmgPart, err = saveImage(ctx, c, info[InfoImageLink], info[InfoImageSess], dmgName, opts.OutDir, progress); err != nil {
+				return nil, err
+			}
+		}
+		defer os.Remove(dmgPart)
+
+		if err := verifyImage(ctx, dmgPart, cnkPart, opts.Jobs, progress); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			return nil, &VerifyError{Path: dmgPart, Err: err}
+		}
+
+		// Keep the chunks of a whole download for next time
+		if opts.Chunks != nil && !assembled {
+			result.CacheErr = opts.Chunks.AddImage(dmgPart, cl)
+		}
+	}
+
+	// Only give the files their real names once they are known to be good
+	if result.ChunklistPath, err = client.CommitImage(cnkPart); err != nil {
+		return nil, err
+	}
+	if result.DMGPath, err = client.CommitImage(dmgPart); err != nil {
+		return nil, err
+	}
+
+	if opts.Cache != nil && result.CacheErr == nil {
+		entry, err := opts.Cache.Store(result.Product, cl, result.DMGPath, result.ChunklistPath)
+		if err == nil {
+			// Remember the answer so the image can be found offline
+			err = opts.Cache.AddMetadata(entry, info, cache.Request{
+				BoardID:     opts.BoardID,
+				MLB:         opts.MLB,
+				OSType:      opts.OSType,
+				Diagnostics: opts.Diagnostics,
+			})
+		}
+		result.CacheErr = err
+	}
+
+	return result, nil
+}
+
+// copyCached links or copies the image Apple last gave for the board and OS
+// type out of the cache, without using the network.
+func copyCached(opts Options, progress func(Event)) (*Result, error) {
+	if opts.Cache == nil {
+		return nil, fmt.Errorf("offline use needs a cache")
+	}
+	entry, m, ok := opts.Cache.Find(opts.BoardID, opts.OSType, opts.Diagnostics)
+	if !ok {
+		return nil, fmt.Errorf("no image for board %s (%s) in the cache %s", opts.BoardID, opts.OSType, opts.Cache.Dir)
+	}
+
+	if err := os.MkdirAll(opts.OutDir, 0755); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Product: entry.Product, Info: m.ImageInfo, Cached: true}
+	progress(Event{Kind: EventImageInfo, Product: result.Product})
+	progress(Event{Kind: EventCached, Product: result.Product, File: entry.DMG()})
+
+	files := []struct {
+		src, link, ext string
+		dst            *string
+	}{
+		{entry.Chunklist(), m.ImageInfo[InfoSignLink], ".chunklist", &result.ChunklistPath},
+		{entry.DMG(), m.ImageInfo[InfoImageLink], ".dmg", &result.DMGPath},
+	}
+	var parts []string
+	for _, f := range files {
+		name := opts.Basename + f.ext
+		if opts.Basename == "" {
+			name = "BaseSystem" + f.ext
+			if link, err := url.Parse(f.link); err == nil && f.link != "" {
+				name = path.Base(link.Path)
+			}
+		}
+		part := filepath.Join(opts.OutDir, name) + PartSuffix
+		defer os.Remove(part)
+		if err := cache.LinkOrCopy(f.src, part); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+
+	for i, f := range files {
+		var err error
+		if *f.dst, err = client.CommitImage(parts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// lookupCache finds the image for product and its chunklist in c, if there
+// is a cache.
+func lookupCache(c *cache.Cache, product string, cl *chunklist.Chunklist) (cache.Entry, bool) {
+	if c == nil {
+		return cache.Entry{}, false
+	}
+	return c.Lookup(product, cl)
+}
+
+// saveImage downloads one file with c.SaveImage, reporting it as Events.
+func saveImage(ctx context.Context, c *client.Client, urlStr, token, filename, directory string, progress func(Event)) (string, error) {
+	var total int64
+	partPath, err := c.SaveImage(ctx, urlStr, token, filename, directory, func(path string, done, size int64) {
+		total = size
+		if done == 0 {
+			progress(Event{Kind: EventDownloadStart, File: path, URL: urlStr, Total: size})
+			return
+		}
+		progress(Event{Kind: EventDownloadProgress, File: path, Done: done, Total: size})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	progress(Event{Kind: EventDownloadDone, File: strings.TrimSuffix(partPath, PartSuffix), URL: urlStr, Done: total, Total: total})
+	return partPath, nil
+}
+
+// verifyImage checks dmgPath against the chunklist at cnkPath, reporting
+// progress as Events.
+func verifyImage(ctx context.Context, dmgPath, cnkPath string, jobs int, progress func(Event)) error {
+	progress(Event{Kind: EventVerifyStart, File: dmgPath})
+
+	err := chunklist.VerifyFile(ctx, dmgPath, cnkPath, jobs, func(done, total int) {
+		progress(Event{Kind: EventVerifyProgress, File: dmgPath, Done: int64(done), Total: int64(total)})
+	})
+	if err != nil {
+		return err
+	}
+
+	progress(Event{Kind: EventVerifyDone, File: dmgPath})
+	return nil
+}
+
+// Most bytes asked for in one range request when assembling an image
+const maxRangeSize = 64 * 1024 * 1024
+
+// assembleImage builds the image at partPath from the chunks in the store,
+// fetching runs of missing chunks from urlStr by byte range and adding them
+// to the store. It returns client.ErrNoRanges if the server cannot send
+// ranges, in which case nothing is left behind.
+func assembleImage(ctx context.Context, c *client.Client, store *cache.ChunkStore, urlStr, token string, cl *chunklist.Chunklist, partPath string, progress func(Event)) error {
+	file, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			file.Close()
+			os.Remove(partPath)
+		}
+	}()
+
+	fullPath := strings.TrimSuffix(partPath, PartSuffix)
+	total := cl.Size()
+	offsets := cl.Offsets()
+	progress(Event{Kind: EventDownloadStart, File: fullPath, URL: urlStr, Total: total})
+
+	readTimeout := c.Config().ReadTimeout
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	fail := func(err error) error {
+		if cause := context.Cause(ctx); cause != nil {
+			return cause
+		}
+		return err
+	}
+
+	var done, reused int64
+	var buf []byte
+	for i := 0; i < len(cl.Chunks); {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+
+		if store.Has(cl.Chunks[i]) {
+			data, err := store.Read(cl.Chunks[i], buf)
+			if err == nil {
+				if _, err := file.Write(data); err != nil {
+					return err
+				}
+				buf = data
+				done += int64(len(data))
+				reused += int64(len(data))
+				progress(Event{Kind: EventDownloadProgress, File: fullPath, Done: done, Total: total})
+				i++
+				continue
+			}
+		}
+
+		// Fetch this chunk and the missing ones straight after it together
+		end := i + 1
+		size := int64(cl.Chunks[i].Size)
+		for end < len(cl.Chunks) && !store.Has(cl.Chunks[end]) && size+int64(cl.Chunks[end].Size) <= maxRangeSize {
+			size += int64(cl.Chunks[end].Size)
+			end++
+		}
+
+		body, err := c.OpenRange(ctx, urlStr, token, offsets[i], offsets[i]+size-1)
+		if err != nil {
+			return fail(err)
+		}
+		// Cancel the range if no data arrives within the read timeout,
+		// counting from when the server answered
+		watchdog := client.NewWatchdog(readTimeout, cancel)
+		reader := watchdog.Reader(body)
+		closeRange := func() {
+			watchdog.Stop()
+			body.Close()
+		}
+		for ; i < end; i++ {
+			chunk := cl.Chunks[i]
+			if uint32(cap(buf)) < chunk.Size {
+				buf = make([]byte, chunk.Size)
+			}
+			buf = buf[:chunk.Size]
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				closeRange()
+				return fail(err)
+			}
+			if sha256.Sum256(buf) != chunk.Hash {
+				closeRange()
+				return fmt.Errorf("invalid chunk %d: hash mismatch", i+1)
+			}
+			if err := store.Put(chunk, buf); err != nil {
+				closeRange()
+				return err
+			}
+			if _, err := file.Write(buf); err != nil {
+				closeRange()
+				return err
+			}
+			done += int64(chunk.Size)
+			progress(Event{Kind: EventDownloadProgress, File: fullPath, Done: done, Total: total})
+		}
+		closeRange()
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	ok = true
+
+	progress(Event{Kind: EventDownloadDone, File: fullPath, URL: urlStr, Done: total, Total: total})
+	progress(Event{Kind: EventChunksReused, File: fullPath, Done: reused, Total: total})
+	return nil
+}
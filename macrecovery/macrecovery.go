@@ -0,0 +1,1045 @@
+// Package macrecovery is a Go port of the OpenCorePkg macrecovery tool. It
+// talks to Apple's osrecovery server to download and verify recovery images,
+// and can be used directly with Download or as a command line tool with Main.
+package macrecovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/cache"
+	"github.com/DrDonk/recoveryOS/catalog"
+	"github.com/DrDonk/recoveryOS/client"
+	"github.com/DrDonk/recoveryOS/mirror"
+	"github.com/DrDonk/recoveryOS/mlb"
+)
+
+// The protocol lives in the client, chunklist, mlb and catalog packages.
+// These names are kept so existing callers keep building.
+const (
+	// Mac identifiers
+	RecentMac  = client.RecentMac
+	MLBZero    = mlb.Zero
+	MLBValid   = mlb.Valid
+	MLBProduct = mlb.Product
+
+	// Info keys
+	InfoProduct   = client.InfoProduct
+	InfoImageLink = client.InfoImageLink
+	InfoImageHash = client.InfoImageHash
+	InfoImageSess = client.InfoImageSess
+	InfoSignLink  = client.InfoSignLink
+	InfoSignHash  = client.InfoSignHash
+	InfoSignSess  = client.InfoSignSess
+
+	// Terminal margin
+	TerminalMargin = 2
+
+	// Suffix for downloads that have not been verified yet
+	PartSuffix = client.PartSuffix
+)
+
+// headerList collects repeated -header "Name: value" flags.
+type headerList [][2]string
+
+func (h *headerList) String() string {
+	var parts []string
+	for _, header := range *h {
+		parts = append(parts, header[0]+": "+header[1])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h *headerList) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("header must be in Name: value format")
+	}
+	*h = append(*h, [2]string{name, strings.TrimSpace(val)})
+	return nil
+}
+
+// hostLimitList collects repeated -host-limit host=count flags.
+type hostLimitList map[string]int
+
+func (l hostLimitList) String() string {
+	var parts []string
+	for host, limit := range l {
+		parts = append(parts, fmt.Sprintf("%s=%d", host, limit))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (l hostLimitList) Set(value string) error {
+	host, count, ok := strings.Cut(value, "=")
+	if !ok || host == "" {
+		return fmt.Errorf("host limit must be in host=count format")
+	}
+	var limit int
+	if _, err := fmt.Sscanf(count, "%d", &limit); err != nil || limit < 1 {
+		return fmt.Errorf("invalid limit %s for %s", count, host)
+	}
+	l[strings.ToLower(host)] = limit
+	return nil
+}
+
+// header returns the collected headers for client.Config.
+func (h headerList) header() http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	header := make(http.Header)
+	for _, pair := range h {
+		header.Add(pair[0], pair[1])
+	}
+	return header
+}
+
+func actionGenerateMLB(code string, year, week int, location string, count int) error {
+	if code == "" {
+		return fmt.Errorf("an EEEE code is needed, use -code")
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		board, serial, err := mlb.GeneratePair(code, year, week, location)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("MLB: %s  Serial: %s\n", board, serial)
+	}
+
+	return nil
+}
+
+func actionModels(filter string) error {
+	models, err := catalog.Models()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-16s %-22s %-5s %-8s %-8s %s\n", "Model", "Board ID", "EEEE", "Min OS", "Max OS", "Name")
+	found := 0
+	for _, m := range models {
+		if filter != "" && !strings.EqualFold(m.Model, filter) {
+			continue
+		}
+		code := m.Code
+		if code == "" {
+			code = "-"
+		}
+		fmt.Printf("%-16s %-22s %-5s %-8s %-8s %s\n", m.Model, m.BoardID, code, m.MinOS, m.MaxOS, m.Name)
+		found++
+	}
+
+	if found == 0 {
+		return fmt.Errorf("unknown model %s", filter)
+	}
+	return nil
+}
+
+// imageInfo asks for the recovery image of a board and MLB.
+func imageInfo(ctx context.Context, c *client.Client, session, board, mlbValue, osType string) (map[string]string, error) {
+	return c.ImageInfo(ctx, session, client.ImageRequest{BoardID: board, MLB: mlbValue, OSType: osType})
+}
+
+// actionUpdateBoards asks Apple for the latest recovery image of every board
+// and compares the macOS version it maps to with boards.json. With readImages
+// the products missing from the product table are downloaded once to read
+// their version from the image.
+func actionUpdateBoards(ctx context.Context, c *client.Client, boardDB, productDB string, readImages, write, verbose bool, jobs int, rate float64) error {
+	boardList, err := catalog.ReadBoards(boardDB)
+	if err != nil {
+		return err
+	}
+	db := boardList.Versions
+
+	products, err := catalog.Products(productDB)
+	if err != nil {
+		return err
+	}
+	// With no products and no images every board other than the latest
+	// would be unknown, so stop before asking Apple about all of them
+	if len(products) == 0 && !readImages {
+		return fmt.Errorf("the product table is empty, give one mapping product IDs to macOS versions with -products or drop -read-images=false")
+	}
+
+	session, err := c.Session(ctx)
+	if err != nil {
+		return err
+	}
+
+	limiter := newRateLimiter(rate)
+	defer limiter.stop()
+
+	if err := limiter.wait(ctx); err != nil {
+		return err
+	}
+	genericLatest, err := imageInfo(ctx, c, session, RecentMac, MLBZero, "latest")
+	if err != nil {
+		return fmt.Errorf("cannot determine latest product: %v", err)
+	}
+
+	// Each answer is the product ID and the version it maps to, or an empty
+	// version when the product is not in the table
+	checkBoard := func(board string) []string {
+		if err := limiter.wait(ctx); err != nil {
+			return nil
+		}
+		latest, err := imageInfo(ctx, c, session, board, MLBZero, "latest")
+		if err != nil {
+			if verbose && ctx.Err() == nil {
+				fmt.Printf("\rFAILED: %s (%v)\n", board, err)
+			}
+			return nil
+		}
+
+		product := latest[InfoProduct]
+		if product == genericLatest[InfoProduct] {
+			return []string{product, catalog.BoardLatest}
+		}
+		return []string{product, products[product]}
+	}
+
+	boards := make([]string, len(boardList.Order))
+	copy(boards, boardList.Order)
+	sort.Strings(boards)
+
+	answers, scanned := scanBoards(ctx, boards, jobs, checkBoard, func(done, found int) {
+		fmt.Printf("\rQueried %d of %d boards", done, len(boards))
+	})
+	fmt.Println()
+
+	// Each product missing from the table is read from the image of the
+	// first board that got it
+	learned := make(map[string]string)
+	if readImages {
+		tried := make(map[string]bool)
+		for _, board := range boards {
+			answer, ok := answers[board]
+			if !ok || answer[1] != "" || tried[answer[0]] || ctx.Err() != nil {
+				continue
+			}
+			product := answer[0]
+			tried[product] = true
+			fmt.Printf("Reading the macOS version of %s from its image\n", product)
+			version, err := productVersion(ctx, c, board, product, jobs)
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("FAILED: %s (%v)\n", product, err)
+				}
+				continue
+			}
+			fmt.Printf("LEARNED: %s is macOS %s\n", product, version)
+			learned[product] = version
+			products[product] = version
+		}
+	}
+
+	changed, mapped := 0, 0
+	var unknown []string
+	for _, board := range boards {
+		answer, ok := answers[board]
+		if !ok {
+			continue
+		}
+		product, version := answer[0], answer[1]
+		if version == "" {
+			version = learned[product]
+		}
+		if version == "" {
+			unknown = append(unknown, product)
+			fmt.Printf("UNKNOWN: %s returned product %s which is not in the product table (boards.json has %s)\n", board, product, db[board])
+			continue
+		}
+		if version != catalog.BoardLatest {
+			mapped++
+		}
+		if version != db[board] {
+			fmt.Printf("CHANGED: %s %s -> %s (%s)\n", board, db[board], version, product)
+			db[board] = version
+			changed++
+		}
+	}
+
+	if failed := scanned - len(answers); failed > 0 {
+		fmt.Printf("WARNING: %d boards gave no answer and were left unchanged\n", failed)
+	}
+	if len(unknown) > 0 {
+		fmt.Println("Add these products to the product table with their macOS versions to update those boards:")
+		seen := make(map[string]bool)
+		for _, product := range unknown {
+			if !seen[product] {
+				fmt.Printf("- %s\n", product)
+				seen[product] = true
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		fmt.Printf("INTERRUPTED: Only %d of %d boards were queried, %s not written\n", scanned, len(boards), boardDB)
+		return ctx.Err()
+	}
+
+	// A table that matches none of the products is the wrong table, not a
+	// list of boards to update
+	if mapped == 0 && len(unknown) > 0 {
+		return fmt.Errorf("none of the products returned for %d boards are in the product table, %s not updated", len(unknown), boardDB)
+	}
+
+	if len(learned) > 0 {
+		switch {
+		case productDB == "":
+			fmt.Println("Save the versions read from images in a product table given with -products to skip downloading them next time")
+		case !write:
+			fmt.Printf("%d products read from images, use -write to add them to %s\n", len(learned), productDB)
+		default:
+			if err := catalog.WriteProducts(productDB, products); err != nil {
+				return err
+			}
+			fmt.Printf("SUCCESS: Added %d products to %s\n", len(learned), productDB)
+		}
+	}
+
+	if changed == 0 {
+		fmt.Printf("SUCCESS: %s is up to date!\n", boardDB)
+		return nil
+	}
+
+	if !write {
+		fmt.Printf("%d boards changed, use -write to update %s\n", changed, boardDB)
+		return nil
+	}
+
+	if err := boardList.Write(boardDB); err != nil {
+		return err
+	}
+	fmt.Printf("SUCCESS: Updated %d boards in %s\n", changed, boardDB)
+	return nil
+}
+
+func actionValidateMLB(value string) error {
+	info, err := mlb.Decode(value)
+
+	fmt.Printf("MLB:        %s\n", value)
+	if info.Format != "" {
+		fmt.Printf("Format:     %s\n", info.Format)
+		if info.Location != "" {
+			fmt.Printf("Location:   %s (%s)\n", info.Location, mlb.LocationName(info.Location))
+		}
+		if info.Format == mlb.FormatFull {
+			fmt.Printf("Year:       %s (201%c or 202%c)\n", value[3:4], value[3], value[3])
+			fmt.Printf("Week:       %s\n", value[4:6])
+			fmt.Printf("Unit:       %s\n", info.Unit)
+		}
+		fmt.Printf("Model code: %s\n", info.Code)
+		if info.Format == mlb.FormatFull {
+			fmt.Printf("Revision:   %s\n", info.Revision)
+			status := "valid"
+			if !info.ChecksumOK {
+				status = "invalid"
+			}
+			fmt.Printf("Checksum:   %s (%s)\n", info.Checksum, status)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("MLB %s is not valid: %v", value, err)
+	}
+
+	fmt.Printf("SUCCESS: %s MLB is structurally valid!\n", value)
+	return nil
+}
+
+// TerminalProgress returns a progress function for Options that draws
+// download and verification progress on the terminal.
+func TerminalProgress() func(Event) {
+	oldTerminalSize := 0
+
+	return func(e Event) {
+		terminalSize := getTerminalWidth() - TerminalMargin
+		if terminalSize < 0 {
+			terminalSize = 0
+		}
+
+		switch e.Kind {
+		case EventImageInfo:
+			fmt.Printf("Downloading %s...\n", e.Product)
+		case EventDownloadStart:
+			fmt.Printf("Saving %s to %s...\n", e.URL, e.File)
+		case EventDownloadProgress:
+			if oldTerminalSize != terminalSize {
+				fmt.Printf("\r%*s", terminalSize, "")
+				oldTerminalSize = terminalSize
+			}
+
+			if e.Total > 0 {
+				progress := float64(e.Done) / float64(e.Total)
+				barWidth := terminalSize / 3
+				fmt.Printf("\r%.1f/%.1f MB ", float64(e.Done)/(1024*1024), float64(e.Total)/(1024*1024))
+				if terminalSize > 55 {
+					filled := int(float64(barWidth) * progress)
+					fmt.Printf("|%s%*s|", strings.Repeat("=", filled), barWidth-filled, "")
+				}
+				fmt.Printf(" %.1f%% downloaded", progress*100)
+			} else {
+				fmt.Printf("\r%.1f MB downloaded...", float64(e.Done)/(1024*1024))
+			}
+		case EventDownloadDone:
+			fmt.Println("\nDownload complete!")
+		case EventVerifyStart:
+			fmt.Println("Verifying image with chunklist...")
+		case EventVerifyProgress:
+			fmt.Printf("\r%-*s", terminalSize, fmt.Sprintf("Chunk %d of %d verified", e.Done, e.Total))
+		case EventVerifyDone:
+			fmt.Println("\nImage verification complete!")
+		case EventCached:
+			fmt.Printf("Using cached copy from %s\n", e.File)
+		case EventChunksReused:
+			fmt.Printf("Reused %.1f of %.1f MB from the chunk store\n", float64(e.Done)/(1024*1024), float64(e.Total)/(1024*1024))
+		}
+	}
+}
+
+func getTerminalWidth() int {
+	// Try to get terminal width in a cross-platform way
+	// Default to 80 if unable to determine
+	width := 80
+
+	// This works on Unix-like systems (Linux, macOS)
+	if fileInfo, _ := os.Stdout.Stat(); (fileInfo.Mode() & os.ModeCharDevice) != 0 {
+		// Terminal detection - use environment variable as fallback
+		if cols := os.Getenv("COLUMNS"); cols != "" {
+			fmt.Sscanf(cols, "%d", &width)
+		}
+	}
+
+	return width
+}
+
+// findImagePairs returns the DMG files in directory that have a matching
+// chunklist, plus the DMG files that do not.
+func findImagePairs(directory string) ([][2]string, []string, error) {
+	dmgs, err := filepath.Glob(filepath.Join(directory, "*.dmg"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(dmgs)
+
+	var pairs [][2]string
+	var orphans []string
+	for _, dmg := range dmgs {
+		cnk := strings.TrimSuffix(dmg, ".dmg") + ".chunklist"
+		if _, err := os.Stat(cnk); err != nil {
+			orphans = append(orphans, dmg)
+			continue
+		}
+		pairs = append(pairs, [2]string{dmg, cnk})
+	}
+
+	return pairs, orphans, nil
+}
+
+func actionVerifyImage(ctx context.Context, dmgPath, cnkPath, directory string, jobs int) error {
+	var pairs [][2]string
+	if dmgPath != "" {
+		if cnkPath == "" {
+			cnkPath = strings.TrimSuffix(dmgPath, filepath.Ext(dmgPath)) + ".chunklist"
+		}
+		pairs = append(pairs, [2]string{dmgPath, cnkPath})
+	} else {
+		var orphans []string
+		var err error
+		pairs, orphans, err = findImagePairs(directory)
+		if err != nil {
+			return err
+		}
+		for _, dmg := range orphans {
+			fmt.Printf("SKIPPED: %s has no matching chunklist\n", dmg)
+		}
+		if len(pairs) == 0 {
+			return fmt.Errorf("no DMG and chunklist pairs found in %s", directory)
+		}
+	}
+
+	progress := TerminalProgress()
+	failures := 0
+	for _, pair := range pairs {
+		fmt.Printf("Checking %s against %s\n", pair[0], pair[1])
+		if err := verifyImage(ctx, pair[0], pair[1], jobs, progress); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			fmt.Printf("\rFAILED: %s (%v)\n", pair[0], err)
+			failures++
+			continue
+		}
+		fmt.Printf("OK: %s\n", pair[0])
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d images failed verification", failures, len(pairs))
+	}
+	return nil
+}
+
+func actionDownload(ctx context.Context, c *client.Client, store *cache.Cache, chunks *cache.ChunkStore, offline bool, boardID, mlbValue, osType, outdir, basename string, diagnostics, verbose bool, jobs int) error {
+	opts := Options{
+		Client:      c,
+		Cache:       store,
+		Offline:     offline,
+		Chunks:      chunks,
+		BoardID:     boardID,
+		MLB:         mlbValue,
+		OSType:      osType,
+		Diagnostics: diagnostics,
+		OutDir:      outdir,
+		Basename:    basename,
+		Jobs:        jobs,
+		Progress:    TerminalProgress(),
+	}
+	if verbose {
+		opts.Log = os.Stdout
+	}
+	result, err := Download(ctx, opts)
+	var verifyErr *VerifyError
+	if errors.As(err, &verifyErr) {
+		fmt.Printf("\rImage verification failed. (%v)\n", verifyErr.Err)
+	}
+	if err == nil && result.CacheErr != nil {
+		fmt.Printf("WARNING: Image not added to the cache (%v)\n", result.CacheErr)
+	}
+	return err
+}
+
+// actionCache lists, verifies or prunes the download cache.
+func actionCache(ctx context.Context, store *cache.Cache, op string, maxAge time.Duration, maxSize int64, jobs int) error {
+	switch op {
+	case "", "list":
+		entries, err := store.List()
+		if err != nil {
+			return err
+		}
+		var total int64
+		fmt.Printf("%-16s %-16s %10s  %-16s\n", "Product", "Chunklist", "Size (MB)", "Last used")
+		for _, e := range entries {
+			fmt.Printf("%-16s %-16s %10.1f  %s\n", e.Product, e.Digest[:16], float64(e.Size)/(1024*1024), e.LastUsed.Format("2006-01-02 15:04"))
+			total += e.Size
+		}
+		fmt.Printf("%d entries, %.1f MB in %s\n", len(entries), float64(total)/(1024*1024), store.Dir)
+		count, size, err := store.Chunks().Size()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d chunks, %.1f MB in the chunk store\n", count, float64(size)/(1024*1024))
+		return nil
+
+	case "verify":
+		entries, err := store.List()
+		if err != nil {
+			return err
+		}
+		failures := 0
+		for _, e := range entries {
+			err := store.Verify(ctx, e, jobs, func(done, total int) {
+				fmt.Printf("\rChecking %s: chunk %d of %d", e.Product, done, total)
+			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				fmt.Printf("\r%-*s\n", TerminalMargin+60, fmt.Sprintf("FAILED: %s %s (%v), removed", e.Product, e.Digest[:16], err))
+				store.Remove(e)
+				failures++
+				continue
+			}
+			fmt.Printf("\r%-*s\n", TerminalMargin+60, fmt.Sprintf("OK: %s %s", e.Product, e.Digest[:16]))
+		}
+		if failures > 0 {
+			return fmt.Errorf("%d of %d cache entries failed verification", failures, len(entries))
+		}
+		return nil
+
+	case "prune":
+		if maxAge < 0 && maxSize < 0 {
+			return fmt.Errorf("give -max-age or -max-size to prune")
+		}
+		removed, chunks, freed, err := store.Prune(maxAge, maxSize)
+		for _, e := range removed {
+			fmt.Printf("REMOVED: %s %s, last used %s\n", e.Product, e.Digest[:16], e.LastUsed.Format("2006-01-02 15:04"))
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("SUCCESS: Removed %d entries and %d chunks (%.1f MB)\n", len(removed), chunks, float64(freed)/(1024*1024))
+		return nil
+	}
+
+	return fmt.Errorf("unknown cache operation %s, use list, verify or prune", op)
+}
+
+// actionExport verifies the cached images for products, or every image if
+// none are given, and writes them to a bundle at output.
+func actionExport(ctx context.Context, store *cache.Cache, output string, products []string, jobs int) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(products) > 0 {
+		var selected []cache.Entry
+		for _, product := range products {
+			found := false
+			for _, e := range entries {
+				if e.Product == product {
+					selected = append(selected, e)
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s is not in the cache %s", product, store.Dir)
+			}
+		}
+		entries = selected
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("nothing to export, the cache %s is empty", store.Dir)
+	}
+
+	part := output + PartSuffix
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+
+	manifest, err := store.Export(ctx, f, entries, jobs, func(product string, done, total int) {
+		fmt.Printf("\rChecking %s: chunk %d of %d", product, done, total)
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(part, output); err != nil {
+		return err
+	}
+
+	fmt.Printf("\r%-*s\n", TerminalMargin+60, "")
+	for _, e := range manifest.Entries {
+		fmt.Printf("EXPORTED: %s %s\n", e.Product, e.Digest[:16])
+	}
+	fmt.Printf("SUCCESS: Wrote %d images to %s\n", len(manifest.Entries), output)
+	return nil
+}
+
+// actionImport verifies the images in the bundle at path and adds them to
+// the cache.
+func actionImport(ctx context.Context, store *cache.Cache, path string, jobs int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := store.Import(ctx, f, jobs, func(product string, done, total int) {
+		fmt.Printf("\rChecking %s: chunk %d of %d", product, done, total)
+	})
+	fmt.Printf("\r%-*s\n", TerminalMargin+60, "")
+	for _, e := range entries {
+		fmt.Printf("IMPORTED: %s %s\n", e.Product, e.Digest[:16])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("SUCCESS: Added %d images to %s\n", len(entries), store.Dir)
+	return nil
+}
+
+// actionServeMirror serves the osrecovery protocol on listen until ctx is
+// cancelled, keeping the images in store.
+func actionServeMirror(ctx context.Context, c *client.Client, store *cache.Cache, listen, publicURL string, infoTTL time.Duration, jobs int) error {
+	mirrorServer := mirror.New(c, store)
+	mirrorServer.BaseURL = publicURL
+	mirrorServer.InfoTTL = infoTTL
+	mirrorServer.Jobs = jobs
+	mirrorServer.Log = log.New(os.Stdout, "", log.LstdFlags)
+
+	server := &http.Server{Addr: listen, Handler: mirrorServer}
+	errc := make(chan error, 1)
+	go func() { errc <- server.ListenAndServe() }()
+	fmt.Printf("Serving the recovery mirror on %s, images in %s\n", listen, store.Dir)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdown)
+	}
+}
+
+// parseSize reads a size such as 500M or 20G. A plain number is in bytes.
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	var size float64
+	if _, err := fmt.Sscanf(value, "%g", &size); err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %s, use a number with an optional K, M, G or T suffix", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// parseAge reads a duration, also accepting a number of days such as 30d.
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n float64
+		if _, err := fmt.Sscanf(days, "%g", &n); err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %s", value)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+func actionSelfcheck(ctx context.Context, c *client.Client, verbose bool) error {
+	session, err := c.Session(ctx)
+	if err != nil {
+		return err
+	}
+
+	validDefault, _ := imageInfo(ctx, c, session, RecentMac, MLBValid, "default")
+	validLatest, _ := imageInfo(ctx, c, session, RecentMac, MLBValid, "latest")
+	productDefault, _ := imageInfo(ctx, c, session, RecentMac, MLBProduct, "default")
+	productLatest, _ := imageInfo(ctx, c, session, RecentMac, MLBProduct, "latest")
+	genericDefault, _ := imageInfo(ctx, c, session, RecentMac, MLBZero, "default")
+	genericLatest, _ := imageInfo(ctx, c, session, RecentMac, MLBZero, "latest")
+
+	if verbose {
+		fmt.Println(validDefault)
+		fmt.Println(validLatest)
+		fmt.Println(productDefault)
+		fmt.Println(productLatest)
+		fmt.Println(genericDefault)
+		fmt.Println(genericLatest)
+	}
+
+	if validDefault[InfoProduct] == validLatest[InfoProduct] {
+		return fmt.Errorf("cannot determine any previous product, got %s", validDefault[InfoProduct])
+	}
+
+	if productDefault[InfoProduct] != productLatest[InfoProduct] {
+		return fmt.Errorf("latest and default do not match for product MLB")
+	}
+
+	if genericDefault[InfoProduct] != genericLatest[InfoProduct] {
+		return fmt.Errorf("generic MLB gives different product")
+	}
+
+	if validLatest[InfoProduct] != genericLatest[InfoProduct] {
+		return fmt.Errorf("cannot determine unified latest product")
+	}
+
+	if productDefault[InfoProduct] != validDefault[InfoProduct] {
+		return fmt.Errorf("valid and product MLB give mismatch")
+	}
+
+	fmt.Println("SUCCESS: Found no discrepancies with MLB validation algorithm!")
+	return nil
+}
+
+func actionVerify(ctx context.Context, c *client.Client, boardID, mlbValue string, verbose bool) error {
+	session, err := c.Session(ctx)
+	if err != nil {
+		return err
+	}
+
+	genericLatest, _ := imageInfo(ctx, c, session, RecentMac, MLBZero, "latest")
+	uvalidDefault, _ := imageInfo(ctx, c, session, boardID, mlbValue, "default")
+	uvalidLatest, _ := imageInfo(ctx, c, session, boardID, mlbValue, "latest")
+	uproductDefault, _ := imageInfo(ctx, c, session, boardID, mlb.ProductForm(mlbValue), "default")
+
+	if verbose {
+		fmt.Println(genericLatest)
+		fmt.Println(uvalidDefault)
+		fmt.Println(uvalidLatest)
+		fmt.Println(uproductDefault)
+	}
+
+	if uvalidDefault[InfoProduct] != uvalidLatest[InfoProduct] {
+		if uvalidLatest[InfoProduct] == genericLatest[InfoProduct] {
+			fmt.Printf("SUCCESS: %s MLB looks valid and supported!\n", mlbValue)
+		} else {
+			fmt.Printf("SUCCESS: %s MLB looks valid, but probably unsupported!\n", mlbValue)
+		}
+		return nil
+	}
+
+	fmt.Println("UNKNOWN: Run selfcheck, check your board-id, or try again later!")
+	return nil
+}
+
+// rateLimiter spaces requests evenly so no more than the given number are
+// started each second. A nil rateLimiter does not limit anything.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	// Very high rates would round down to a zero interval, which NewTicker
+	// does not accept
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval < 1 {
+		interval = 1
+	}
+	return &rateLimiter{ticker: time.NewTicker(interval)}
+}
+
+func (r *rateLimiter) wait(ctx context.Context) error {
+	if r == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-r.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *rateLimiter) stop() {
+	if r != nil {
+		r.ticker.Stop()
+	}
+}
+
+// scanBoards runs check for each board using jobs workers and collects the
+// non-nil answers. It stops early if ctx is cancelled, returning the results
+// so far, including matches found by checks still running at the time, and
+// the number of boards that were fully checked.
+func scanBoards(ctx context.Context, boards []string, jobs int, check func(board string) []string, progress func(done, found int)) (map[string][]string, int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type boardResult struct {
+		board string
+		info  []string
+	}
+
+	queue := make(chan string)
+	results := make(chan boardResult)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for board := range queue {
+				results <- boardResult{board, check(board)}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(queue)
+		for _, board := range boards {
+			select {
+			case queue <- board:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	found := make(map[string][]string)
+	scanned := 0
+	for r := range results {
+		// Boards with no answer after an interrupt may have been cut short so
+		// are not counted, but any match that completed is kept
+		if r.info == nil && ctx.Err() != nil {
+			continue
+		}
+		scanned++
+		if r.info != nil {
+			found[r.board] = r.info
+		}
+		progress(scanned, len(found))
+	}
+
+	return found, scanned
+}
+
+func actionGuess(ctx context.Context, c *client.Client, mlbValue, boardDB string, verbose bool, jobs int, rate float64) error {
+	anon := strings.HasPrefix(mlbValue, "000")
+
+	file, err := os.Open(boardDB)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var db map[string]string
+	if err := json.NewDecoder(file).Decode(&db); err != nil {
+		return err
+	}
+
+	session, err := c.Session(ctx)
+	if err != nil {
+		return err
+	}
+
+	limiter := newRateLimiter(rate)
+	defer limiter.stop()
+
+	query := func(model, board, osType string) (map[string]string, error) {
+		if err := limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		return imageInfo(ctx, c, session, model, board, osType)
+	}
+
+	genericLatest, _ := query(RecentMac, MLBZero, "latest")
+
+	// checkModel returns the up to, default and latest versions when the MLB
+	// looks supported on model, or nil if it does not.
+	checkModel := func(model string) []string {
+		if anon {
+			modelLatest, err := query(model, MLBZero, "latest")
+			if err != nil {
+				return nil
+			}
+
+			if modelLatest[InfoProduct] != genericLatest[InfoProduct] {
+				return nil
+			}
+
+			userDefault, err := query(model, mlbValue, "default")
+			if err != nil {
+				return nil
+			}
+
+			if userDefault[InfoProduct] != genericLatest[InfoProduct] {
+				return []string{db[model], userDefault[InfoProduct], genericLatest[InfoProduct]}
+			}
+		} else {
+			userLatest, err := query(model, mlbValue, "latest")
+			if err != nil {
+				return nil
+			}
+
+			userDefault, err := query(model, mlbValue, "default")
+			if err != nil {
+				return nil
+			}
+
+			if userLatest[InfoProduct] != userDefault[InfoProduct] {
+				return []string{db[model], userDefault[InfoProduct], userLatest[InfoProduct]}
+			}
+		}
+		return nil
+	}
+
+	models := make([]string, 0, len(db))
+	for model := range db {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	supported, scanned := scanBoards(ctx, models, jobs, checkModel, func(done, found int) {
+		fmt.Printf("\rScanned %d of %d boards, %d supported", done, len(models), found)
+	})
+	fmt.Println()
+
+	var found []string
+	for model := range supported {
+		found = append(found, model)
+	}
+	sort.Strings(found)
+
+	if ctx.Err() != nil {
+		fmt.Printf("INTERRUPTED: Partial results after scanning %d of %d boards\n", scanned, len(models))
+	}
+
+	if len(supported) > 0 {
+		fmt.Printf("SUCCESS: MLB %s looks supported for:\n", mlbValue)
+		for _, model := range found {
+			info := supported[model]
+			fmt.Printf("- %s, up to %s, default: %s, latest: %s\n", model, info[0], info[1], info[2])
+		}
+		return ctx.Err()
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	fmt.Printf("UNKNOWN: Failed to determine supported models for MLB %s!\n", mlbValue)
+	return nil
+}
+
+// Main runs the macrecovery command line tool with args, not including the
+// program name, and returns the exit code. The action is chosen with -action
+// and every option is accepted whatever the action.
+func Main(args []string) int {
+	fs := flag.NewFlagSet("macrecovery", flag.ContinueOnError)
+	action := fs.String("action", "", "Action to perform: "+strings.Join(commandNames(), ", "))
+	s := newSettings()
+	s.register(fs, flagAll)
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	cmd, ok := FindCommand(*action)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid action. Use: %s\n", strings.Join(commandNames(), ", "))
+		fs.Usage()
+		return 1
+	}
+
+	s.args = fs.Args()
+	return s.run(fs, cmd)
+}
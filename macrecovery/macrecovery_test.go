@@ -0,0 +1,251 @@
+package macrecovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/cache"
+	"github.com/DrDonk/recoveryOS/catalog"
+	"github.com/DrDonk/recoveryOS/chunklist"
+	"github.com/DrDonk/recoveryOS/client"
+)
+
+func TestScanBoardsKeepsMatchesAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	check := func(board string) []string {
+		switch board {
+		case "Mac-A":
+			return []string{"found before"}
+		case "Mac-B":
+			// Finds a match only after the user has pressed Ctrl-C
+			close(started)
+			<-ctx.Done()
+			return []string{"found during"}
+		case "Mac-C":
+			<-ctx.Done()
+			return nil
+		}
+		return nil
+	}
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	found, scanned := scanBoards(ctx, []string{"Mac-A", "Mac-B", "Mac-C", "Mac-D", "Mac-E"}, 3, check, func(int, int) {})
+	for _, board := range []string{"Mac-A", "Mac-B"} {
+		if found[board] == nil {
+			t.Errorf("match for %s was lost, found %v", board, found)
+		}
+	}
+	if _, ok := found["Mac-C"]; ok {
+		t.Error("board cut short was reported as a match")
+	}
+	if scanned < 2 || scanned > 4 {
+		t.Errorf("scanned %d boards, want the two matches and any that completed", scanned)
+	}
+}
+
+func TestScanBoards(t *testing.T) {
+	boards := []string{"Mac-1", "Mac-2", "Mac-3", "Mac-4"}
+	found, scanned := scanBoards(context.Background(), boards, 0, func(board string) []string {
+		if board == "Mac-3" {
+			return []string{"yes"}
+		}
+		return nil
+	}, func(int, int) {})
+	if scanned != len(boards) || len(found) != 1 || found["Mac-3"] == nil {
+		t.Errorf("scanned %d with %v, want 4 with Mac-3", scanned, found)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil || newRateLimiter(-1) != nil {
+		t.Error("a rate of zero or less should not limit")
+	}
+
+	// Rates so high the interval rounds to zero must not panic
+	for _, rate := range []float64{1e9, 2e9, 1e300} {
+		limiter := newRateLimiter(rate)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := limiter.wait(ctx); err != nil {
+			t.Errorf("rate %g: %v", rate, err)
+		}
+		cancel()
+		limiter.stop()
+	}
+}
+
+func TestUpdateBoardsEmptyProducts(t *testing.T) {
+	products := filepath.Join(t.TempDir(), "products.json")
+	if err := os.WriteFile(products, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Fails before contacting Apple, so no client is needed
+	err := actionUpdateBoards(context.Background(), nil, filepath.Join("..", "boards.json"), products, false, false, false, 1, 0)
+	if err == nil || !strings.Contains(err.Error(), "product table is empty") {
+		t.Fatalf("update-boards with an empty product table returned %v", err)
+	}
+}
+
+// recoveryServer answers image info requests like Apple's server, giving
+// each board ID the product in products.
+func recoveryServer(t *testing.T, products map[string]string) *client.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "TEST"})
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		for _, line := range strings.Split(string(body), "\n") {
+			if board, ok := strings.CutPrefix(line, "bid="); ok && products[board] != "" {
+				fmt.Fprintf(w, "AP: %s\nAU: http://test/image.dmg\nAH: x\nAT: x\nCU: http://test/image.chunklist\nCH: x\nCT: x\n", products[board])
+				return
+			}
+		}
+		http.Error(w, "unknown board", http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+	c, err := client.New(client.Config{Server: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUpdateBoards(t *testing.T) {
+	c := recoveryServer(t, map[string]string{
+		RecentMac:    "041-00001",
+		"Mac-BBBBBB": "041-00001",
+		"Mac-AAAAAA": "041-00002",
+		"Mac-CCCCCC": "041-00003",
+		"Mac-DDDDDD": "041-00004",
+	})
+	dir := t.TempDir()
+	boardDB := filepath.Join(dir, "boards.json")
+	productDB := filepath.Join(dir, "products.json")
+	boards := &catalog.Boards{
+		Order:    []string{"Mac-AAAAAA", "Mac-BBBBBB", "Mac-CCCCCC", "Mac-DDDDDD"},
+		Versions: map[string]string{"Mac-AAAAAA": "13.0", "Mac-BBBBBB": "14.0", "Mac-CCCCCC": "12.0", "Mac-DDDDDD": "11.0"},
+	}
+	if err := boards.Write(boardDB); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.WriteProducts(productDB, map[string]string{"041-00002": "13.7.8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Products missing from the table are read from their image, which is
+	// only possible for one of them here
+	var read []string
+	defer func(old func(context.Context, *client.Client, string, string, int) (string, error)) {
+		productVersion = old
+	}(productVersion)
+	productVersion = func(ctx context.Context, c *client.Client, board, product string, jobs int) (string, error) {
+		read = append(read, board+" "+product)
+		if product == "041-00003" {
+			return "12.7.6", nil
+		}
+		return "", fmt.Errorf("no SystemVersion.plist")
+	}
+
+	if err := actionUpdateBoards(context.Background(), c, boardDB, productDB, true, true, false, 1, 0); err != nil {
+		t.Fatalf("update-boards: %v", err)
+	}
+	if got, want := strings.Join(read, ", "), "Mac-CCCCCC 041-00003, Mac-DDDDDD 041-00004"; got != want {
+		t.Errorf("read the images of %s, want %s", got, want)
+	}
+
+	updated, err := catalog.ReadBoards(boardDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Mac-AAAAAA": "13.7.8",            // from the product table
+		"Mac-BBBBBB": catalog.BoardLatest, // same image as the newest Mac
+		"Mac-CCCCCC": "12.7.6",            // read from the image
+		"Mac-DDDDDD": "11.0",              // unknown, left as it was
+	}
+	for board, version := range want {
+		if updated.Versions[board] != version {
+			t.Errorf("%s is %s in boards.json, want %s", board, updated.Versions[board], version)
+		}
+	}
+
+	products, err := catalog.Products(productDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || products["041-00003"] != "12.7.6" {
+		t.Errorf("product table is %v, want the version read from the image added", products)
+	}
+}
+
+func TestPlistVersion(t *testing.T) {
+	plist := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>ProductBuildVersion</key>
+	<string>23H420</string>
+	<key>ProductName</key>
+	<string>macOS</string>
+	<key>ProductVersion</key>
+	<string>14.8.4</string>
+</dict>
+</plist>
+`
+	if version, err := plistVersion([]byte(plist)); err != nil || version != "14.8.4" {
+		t.Errorf("plistVersion returned %q, %v, want 14.8.4", version, err)
+	}
+	if _, err := plistVersion([]byte(strings.Replace(plist, "ProductVersion", "Other", 1))); err == nil {
+		t.Error("plistVersion found a version in a plist without one")
+	}
+}
+
+func TestAssembleImageNoReadTimeout(t *testing.T) {
+	data := bytes.Repeat([]byte("recoveryOS"), 5000)
+	cl := &chunklist.Chunklist{}
+	for off := 0; off < len(data); off += 4096 {
+		end := min(off+4096, len(data))
+		cl.Chunks = append(cl.Chunks, chunklist.Chunk{Size: uint32(end - off), Hash: sha256.Sum256(data[off:end])})
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image.dmg", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	store, err := cache.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A zero read timeout means no limit, not one that has already passed
+	cfg := client.DefaultConfig()
+	cfg.ReadTimeout = 0
+	c, err := client.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	part := filepath.Join(t.TempDir(), "image.dmg"+PartSuffix)
+	if err := assembleImage(context.Background(), c, store.Chunks(), server.URL+"/image.dmg", "token", cl, part, func(Event) {}); err != nil {
+		t.Fatalf("assembleImage: %v", err)
+	}
+	if got, _ := os.ReadFile(part); !bytes.Equal(got, data) {
+		t.Error("assembled image differs from the original")
+	}
+}
@@ -0,0 +1,155 @@
+package macrecovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/DrDonk/recoveryOS/client"
+)
+
+// systemVersionPath is the file in a recovery image naming its macOS version.
+const systemVersionPath = "System/Library/CoreServices/SystemVersion.plist"
+
+// productVersion downloads the image board gets as its latest, which Apple
+// answered with product, and reads its macOS version. It is a variable so
+// tests can answer without downloading.
+var productVersion = func(ctx context.Context, c *client.Client, board, product string, jobs int) (string, error) {
+	dir, err := os.MkdirTemp("", "recoveryOS-update-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	result, err := Download(ctx, Options{
+		Client:   c,
+		BoardID:  board,
+		OSType:   "latest",
+		OutDir:   dir,
+		Jobs:     jobs,
+		Progress: TerminalProgress(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.Product != product {
+		return "", fmt.Errorf("%s now gets %s instead of %s", board, result.Product, product)
+	}
+	return imageVersion(ctx, result.DMGPath)
+}
+
+// imageVersion reads the macOS version from SystemVersion.plist in the
+// recovery image dmg. The image is mounted with hdiutil on macOS and read
+// with 7-Zip elsewhere.
+func imageVersion(ctx context.Context, dmg string) (string, error) {
+	var data []byte
+	var err error
+	if runtime.GOOS == "darwin" {
+		data, err = hdiutilRead(ctx, dmg)
+	} else {
+		data, err = sevenZipRead(ctx, dmg)
+	}
+	if err != nil {
+		return "", err
+	}
+	return plistVersion(data)
+}
+
+// hdiutilRead mounts dmg read only and reads SystemVersion.plist from it.
+func hdiutilRead(ctx context.Context, dmg string) ([]byte, error) {
+	mount, err := os.MkdirTemp("", "recoveryOS-mount-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(mount)
+
+	out, err := exec.CommandContext(ctx, "hdiutil", "attach", "-nobrowse", "-readonly", "-noverify", "-noautoopen", "-mountpoint", mount, dmg).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("hdiutil attach %s failed: %v\n%s", dmg, err, out)
+	}
+	// Detached without ctx, so an interrupted run does not leave it mounted
+	defer exec.Command("hdiutil", "detach", "-force", mount).Run()
+	return os.ReadFile(filepath.Join(mount, filepath.FromSlash(systemVersionPath)))
+}
+
+// sevenZipRead extracts SystemVersion.plist from dmg with 7-Zip. The image
+// holds a partition map and the volume, so the volume is extracted first and
+// the file read from that.
+func sevenZipRead(ctx context.Context, dmg string) ([]byte, error) {
+	var tool string
+	for _, name := range []string{"7zz", "7z", "7za"} {
+		if path, err := exec.LookPath(name); err == nil {
+			tool = path
+			break
+		}
+	}
+	if tool == "" {
+		return nil, fmt.Errorf("7-Zip (7zz or 7z) not found, it is needed to read the macOS version from %s", dmg)
+	}
+
+	dir, err := os.MkdirTemp("", "recoveryOS-7z-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(args ...string) error {
+		out, err := exec.CommandContext(ctx, tool, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s %s failed: %v\n%s", filepath.Base(tool), args[0], err, out)
+		}
+		return nil
+	}
+	if err := run("e", "-y", "-o"+dir, dmg, "*.hfs", "*.apfs"); err != nil {
+		return nil, err
+	}
+	volumes, _ := filepath.Glob(filepath.Join(dir, "*.*fs"))
+	for _, volume := range volumes {
+		out := filepath.Join(dir, "plist")
+		if err := run("e", "-y", "-r", "-o"+out, volume, filepath.Base(systemVersionPath)); err != nil {
+			return nil, err
+		}
+		if data, err := os.ReadFile(filepath.Join(out, filepath.Base(systemVersionPath))); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no %s", dmg, systemVersionPath)
+}
+
+// plistVersion returns the ProductVersion in a SystemVersion.plist.
+func plistVersion(data []byte) (string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var key string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return "", fmt.Errorf("no ProductVersion in %s", filepath.Base(systemVersionPath))
+		} else if err != nil {
+			return "", fmt.Errorf("invalid %s: %v", filepath.Base(systemVersionPath), err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "key":
+			if err := dec.DecodeElement(&key, &start); err != nil {
+				return "", err
+			}
+		case "string":
+			var value string
+			if err := dec.DecodeElement(&value, &start); err != nil {
+				return "", err
+			}
+			if key == "ProductVersion" {
+				return value, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Package manifest records how recoveryOS produced a set of images: the
+// request sent to Apple, its answer, how the image was checked, the
+// conversions made and the SHA-256 of every file, so images in circulation
+// can be traced back to where they came from.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Suffix is added to the base name of the outputs to name their manifest.
+const Suffix = ".manifest.json"
+
+// Kinds of artifact
+const (
+	KindImage     = "image"
+	KindChunklist = "chunklist"
+	KindDisk      = "disk"
+	KindVM        = "vm"
+)
+
+// Verification statuses
+const (
+	StatusPassed    = "passed"    // checked against the chunklist after downloading
+	StatusCached    = "cached"    // taken from the cache, which only holds images that passed
+	StatusUnchecked = "unchecked" // converted from an existing image recoveryOS did not download
+)
+
+// Manifest describes one run of recoveryOS and the files it left behind.
+type Manifest struct {
+	Tool         Tool              `json:"tool"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Inputs       Inputs            `json:"inputs"`
+	Product      string            `json:"product,omitempty"`
+	Source       string            `json:"source,omitempty"` // apple, cache or offline
+	ImageInfo    map[string]string `json:"image_info,omitempty"`
+	Verification Verification      `json:"verification"`
+	Conversions  []Conversion      `json:"conversions,omitempty"`
+	Artifacts    []Artifact        `json:"artifacts"`
+}
+
+// Tool identifies the recoveryOS build.
+type Tool struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// Inputs is what was asked for.
+type Inputs struct {
+	OS          string `json:"os,omitempty"`
+	BoardID     string `json:"board_id,omitempty"`
+	MLB         string `json:"mlb,omitempty"`
+	OSType      string `json:"os_type,omitempty"`
+	Diagnostics bool   `json:"diagnostics,omitempty"`
+}
+
+// Verification is how the image was checked.
+type Verification struct {
+	Status          string    `json:"status"`
+	Chunks          int       `json:"chunks,omitempty"`
+	ChunklistDigest string    `json:"chunklist_digest,omitempty"` // the SHA-256 the chunklist signs
+	Time            time.Time `json:"time,omitempty"`
+}
+
+// Conversion is one conversion of the image to a virtual disk.
+type Conversion struct {
+	Format           string    `json:"format"`
+	Output           string    `json:"output"`
+	Converter        string    `json:"converter"`
+	ConverterVersion string    `json:"converter_version,omitempty"`
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// Artifact is one file produced, named by its slash separated path relative
+// to the manifest.
+type Artifact struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Path returns the manifest file for outputs named basename.
+func Path(basename string) string {
+	return basename + Suffix
+}
+
+// New returns an empty manifest for a run starting now.
+func New(tool Tool) *Manifest {
+	return &Manifest{Tool: tool, Started: time.Now().UTC()}
+}
+
+// Read loads a manifest.
+func Read(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Write saves the manifest, marking the run finished now.
+func (m *Manifest) Write(path string) error {
+	m.Finished = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	part := path + ".part"
+	if err := os.WriteFile(part, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(part, path); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return nil
+}
+
+// AddArtifact hashes the file at path, which is in the same folder as the
+// manifest, and records it, replacing any earlier record of a file with the
+// same name.
+func (m *Manifest) AddArtifact(path, kind string) error {
+	return m.AddArtifactAs(filepath.Base(path), path, kind)
+}
+
+// AddArtifactAs is AddArtifact for a file in a folder below the manifest,
+// recorded as name, its path relative to the manifest.
+func (m *Manifest) AddArtifactAs(name, path, kind string) error {
+	sum, size, err := HashFile(path)
+	if err != nil {
+		return err
+	}
+
+	artifact := Artifact{Name: filepath.ToSlash(name), Kind: kind, Size: size, SHA256: sum}
+	for i, a := range m.Artifacts {
+		if a.Name == artifact.Name {
+			m.Artifacts[i] = artifact
+			return nil
+		}
+	}
+	m.Artifacts = append(m.Artifacts, artifact)
+	return nil
+}
+
+// HashFile returns the hex SHA-256 and size of the file at path.
+func HashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,168 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffixes of the files written alongside artifacts and manifests
+const (
+	SidecarSuffix   = ".sha256"
+	SignatureSuffix = ".sig"
+)
+
+// WriteSidecar writes path.sha256 in the format of shasum, so it can also be
+// checked with shasum -a 256 -c in the same folder.
+func WriteSidecar(path, sum string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+	return os.WriteFile(path+SidecarSuffix, []byte(line), 0644)
+}
+
+// CheckSidecar hashes the file at path and compares it with path.sha256.
+func CheckSidecar(path string) error {
+	data, err := os.ReadFile(path + SidecarSuffix)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("%s is empty", path+SidecarSuffix)
+	}
+	return checkHash(path, fields[0])
+}
+
+// checkHash compares the SHA-256 of the file at path with want.
+func checkHash(path, want string) error {
+	sum, _, err := HashFile(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, want) {
+		return fmt.Errorf("%s: SHA-256 is %s, expected %s", path, sum, want)
+	}
+	return nil
+}
+
+// Check compares every artifact with the files in dir, the folder holding
+// the manifest, and returns an error for each that is missing or differs.
+func (m *Manifest) Check(dir string) []error {
+	var errs []error
+	for _, a := range m.Artifacts {
+		if err := checkHash(filepath.Join(dir, filepath.FromSlash(a.Name)), a.SHA256); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// GenerateKey creates an ed25519 key pair, writing the private key to
+// privPath and the public key to pubPath as PEM, the same formats openssl
+// uses.
+func GenerateKey(privPath, pubPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+}
+
+// readPEM returns the DER bytes of the first PEM block of type in path.
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s is not a PEM %s", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// ReadPrivateKey loads an ed25519 private key written by GenerateKey or
+// openssl genpkey -algorithm ed25519.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// ReadPublicKey loads an ed25519 public key written by GenerateKey or
+// openssl pkey -pubout.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return pub, nil
+}
+
+// SignFile signs the contents of path with key and writes the base64
+// signature to path.sig.
+func SignFile(path string, key ed25519.PrivateKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return os.WriteFile(path+SignatureSuffix, []byte(sig+"\n"), 0644)
+}
+
+// VerifyFile checks path.sig is a signature of the contents of path by the
+// holder of the private key for pub.
+func VerifyFile(path string, pub ed25519.PublicKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	encoded, err := os.ReadFile(path + SignatureSuffix)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path+SignatureSuffix, err)
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return fmt.Errorf("%s: signature does not match", filepath.Base(path))
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package manifest
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeManifest writes a manifest listing one artifact in a new folder and
+// returns the folder and the manifest path.
+func writeManifest(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	image := filepath.Join(dir, "sonoma.vmdk")
+	if err := os.WriteFile(image, []byte("disk image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := New(Tool{Name: "recoveryOS"})
+	if err := m.AddArtifact(image, "vmdk"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, Path("sonoma"))
+	if err := m.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+// notExist stands for a missing file error, whose text differs between
+// systems.
+const notExist = "file does not exist"
+
+// errorMatches reports whether err contains want.
+func errorMatches(err error, want string) bool {
+	if want == notExist {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	return err != nil && strings.Contains(err.Error(), want)
+}
+
+// keyPair generates a key pair with GenerateKey and reads it back.
+func keyPair(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	priv, pub := filepath.Join(dir, "signing.key"), filepath.Join(dir, "signing.pub")
+	if err := GenerateKey(priv, pub); err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestSignVerify(t *testing.T) {
+	privPath, pubPath := keyPair(t)
+	priv, err := ReadPrivateKey(privPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ReadPublicKey(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPubPath := keyPair(t)
+	otherPub, err := ReadPublicKey(otherPubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T, path string) // applied after signing
+		want   string                          // part of the error, empty for none
+	}{
+		{"signed", nil, ""},
+		{"tampered manifest", func(t *testing.T, path string) {
+			data, _ := os.ReadFile(path)
+			os.WriteFile(path, []byte(strings.Replace(string(data), "vmdk", "qcow", 1)), 0644)
+		}, "signature does not match"},
+		{"bad base64", func(t *testing.T, path string) {
+			os.WriteFile(path+SignatureSuffix, []byte("not base64!\n"), 0644)
+		}, SignatureSuffix},
+		{"missing signature", func(t *testing.T, path string) {
+			os.Remove(path + SignatureSuffix)
+		}, notExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, path := writeManifest(t)
+			if err := SignFile(path, priv); err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				tt.change(t, path)
+			}
+			err := VerifyFile(path, pub)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("VerifyFile: %v", err)
+				}
+				if VerifyFile(path, otherPub) == nil {
+					t.Error("signature verified with the wrong key")
+				}
+				return
+			}
+			if !errorMatches(err, tt.want) {
+				t.Fatalf("VerifyFile error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadKeyErrors(t *testing.T) {
+	privPath, pubPath := keyPair(t)
+	if _, err := ReadPrivateKey(pubPath); err == nil {
+		t.Error("ReadPrivateKey accepted a public key")
+	}
+	if _, err := ReadPublicKey(privPath); err == nil {
+		t.Error("ReadPublicKey accepted a private key")
+	}
+}
+
+func TestSidecar(t *testing.T) {
+	dir, _ := writeManifest(t)
+	image := filepath.Join(dir, "sonoma.vmdk")
+	sum, _, err := HashFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sidecar string // contents of the .sha256 file, empty for none
+		want    string // part of the error, empty for none
+	}{
+		{"good", sum + "  sonoma.vmdk\n", ""},
+		{"upper case", strings.ToUpper(sum) + "  sonoma.vmdk\n", ""},
+		{"wrong hash", strings.Repeat("0", 64) + "  sonoma.vmdk\n", "SHA-256 is"},
+		{"empty", "\n", "is empty"},
+		{"missing", "", notExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(image + SidecarSuffix)
+			if tt.sidecar != "" {
+				if err := os.WriteFile(image+SidecarSuffix, []byte(tt.sidecar), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := CheckSidecar(image)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("CheckSidecar: %v", err)
+				}
+				return
+			}
+			if !errorMatches(err, tt.want) {
+				t.Fatalf("CheckSidecar error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// WriteSidecar writes what CheckSidecar reads
+	if err := WriteSidecar(image, sum); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSidecar(image); err != nil {
+		t.Errorf("CheckSidecar of a written sidecar: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, path := writeManifest(t)
+	m, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := m.Check(dir); len(errs) != 0 {
+		t.Fatalf("Check: %v", errs)
+	}
+
+	os.WriteFile(filepath.Join(dir, "sonoma.vmdk"), []byte("changed"), 0644)
+	if errs := m.Check(dir); len(errs) != 1 {
+		t.Errorf("Check of a changed artifact returned %v, want one error", errs)
+	}
+	os.Remove(filepath.Join(dir, "sonoma.vmdk"))
+	if errs := m.Check(dir); len(errs) != 1 {
+		t.Errorf("Check of a missing artifact returned %v, want one error", errs)
+	}
+}
@@ -0,0 +1,396 @@
+// Package mirror serves the osrecovery protocol to Macs and virtual machines
+// on the local network, fetching each image from Apple once and keeping it in
+// a cache.
+//
+// Clients are pointed at the mirror instead of osrecovery.apple.com, usually
+// with a DNS override. Sessions and image info requests are answered like
+// Apple's server, with the image and chunklist links rewritten to point back
+// at the mirror. Image info answers are forwarded from Apple the first time a
+// board, MLB and OS type is seen and then kept for InfoTTL.
+package mirror
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/cache"
+	"github.com/DrDonk/recoveryOS/chunklist"
+	"github.com/DrDonk/recoveryOS/client"
+)
+
+// Server is an http.Handler that mirrors the recovery server.
+type Server struct {
+	// Client fetches from Apple.
+	Client *client.Client
+	// Cache holds the verified images.
+	Cache *cache.Cache
+	// BaseURL is the address clients use to reach the mirror, such as
+	// http://mirror.lan:8080. When empty the Host of each request is used.
+	BaseURL string
+	// InfoTTL is how long image info answers are reused.
+	InfoTTL time.Duration
+	// Jobs is the number of chunks hashed in parallel when verifying.
+	Jobs int
+	// Log, if not nil, receives a line for each request.
+	Log *log.Logger
+
+	mu       sync.Mutex
+	session  string
+	infos    map[string]cachedInfo
+	products map[string]*product
+	fetches  map[string]*fetch
+}
+
+// product is Apple's answer for a product and the requests it was given for,
+// kept to fetch the image and record where it came from.
+type product struct {
+	info     map[string]string
+	expires  time.Time // when the asset tokens in info may stop working
+	requests []cache.Request
+}
+
+type cachedInfo struct {
+	info    map[string]string
+	expires time.Time
+}
+
+// fetch is a download in progress that other requests for the same product
+// wait for.
+type fetch struct {
+	done  chan struct{}
+	entry cache.Entry
+	err   error
+}
+
+// New returns a Server using c to reach Apple and store for the images.
+func New(c *client.Client, store *cache.Cache) *Server {
+	return &Server{
+		Client:   c,
+		Cache:    store,
+		InfoTTL:  24 * time.Hour,
+		infos:    make(map[string]cachedInfo),
+		products: make(map[string]*product),
+		fetches:  make(map[string]*fetch),
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, args...)
+	}
+}
+
+// ServeHTTP answers session, image info and image requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.serveSession(w, r)
+	case r.URL.Path == "/InstallationPayload/RecoveryImage" && r.Method == http.MethodPost:
+		s.serveInfo(w, r, false)
+	case r.URL.Path == "/InstallationPayload/Diagnostics" && r.Method == http.MethodPost:
+		s.serveInfo(w, r, true)
+	case strings.HasPrefix(r.URL.Path, "/image/") && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.serveImage(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request) {
+	token := make([]byte, 16)
+	rand.Read(token)
+	http.SetCookie(w, &http.Cookie{Name: "session", Value: strings.ToUpper(hex.EncodeToString(token)), Path: "/"})
+	w.WriteHeader(http.StatusOK)
+}
+
+// upstreamInfo asks Apple for image info, opening a new session if there is
+// none or the old one has stopped working.
+func (s *Server) upstreamInfo(ctx context.Context, req client.ImageRequest) (map[string]string, error) {
+	s.mu.Lock()
+	session := s.session
+	s.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if session == "" {
+			var err error
+			if session, err = s.Client.Session(ctx); err != nil {
+				return nil, err
+			}
+			s.mu.Lock()
+			s.session = session
+			s.mu.Unlock()
+		}
+
+		info, err := s.Client.ImageInfo(ctx, session, req)
+		if err == nil || attempt > 0 {
+			return info, err
+		}
+		session = ""
+	}
+	return nil, fmt.Errorf("no session")
+}
+
+func (s *Server) serveInfo(w http.ResponseWriter, r *http.Request, diag bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	post := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			post[k] = v
+		}
+	}
+
+	req := client.ImageRequest{
+		BoardID:     post["bid"],
+		MLB:         post["sn"],
+		OSType:      post["os"],
+		Diagnostics: diag,
+		ClientID:    post["cid"],
+	}
+
+	s.mu.Lock()
+	cached, ok := s.infos[infoKey(req)]
+	s.mu.Unlock()
+
+	info := cached.info
+	if !ok || time.Now().After(cached.expires) {
+		if info, err = s.upstreamInfo(r.Context(), req); err != nil {
+			s.logf("info %s %s: %v", req.BoardID, req.OSType, err)
+			status := http.StatusBadGateway
+			if httpErr, ok := err.(*client.HTTPError); ok {
+				status = httpErr.StatusCode
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		s.remember(req, info)
+		s.logf("info %s %s: %s from Apple", req.BoardID, req.OSType, info[client.InfoProduct])
+	} else {
+		s.logf("info %s %s: %s from cache", req.BoardID, req.OSType, info[client.InfoProduct])
+	}
+
+	// Send the client to the mirror for the files, keeping the rest as is
+	base := s.BaseURL
+	if base == "" {
+		base = "http://" + r.Host
+	}
+	base = strings.TrimSuffix(base, "/") + "/image/" + url.PathEscape(info[client.InfoProduct]) + "/"
+
+	var out strings.Builder
+	for _, k := range client.InfoRequired {
+		v := info[k]
+		switch k {
+		case client.InfoImageLink, client.InfoSignLink:
+			v = base + path.Base(linkPath(v))
+		}
+		fmt.Fprintf(&out, "%s: %s\n", k, v)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, out.String())
+}
+
+// infoKey returns the key image info answers for req are kept under.
+func infoKey(req client.ImageRequest) string {
+	return fmt.Sprintf("%t|%s|%s|%s", req.Diagnostics, req.BoardID, req.MLB, req.OSType)
+}
+
+// remember keeps Apple's answer to req for InfoTTL, as the answer for req and
+// the latest info for its product.
+func (s *Server) remember(req client.ImageRequest, info map[string]string) {
+	expires := time.Now().Add(s.InfoTTL)
+	r := cache.Request{BoardID: req.BoardID, MLB: req.MLB, OSType: req.OSType, Diagnostics: req.Diagnostics}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infos[infoKey(req)] = cachedInfo{info, expires}
+	p := s.products[info[client.InfoProduct]]
+	if p == nil {
+		p = &product{}
+		s.products[info[client.InfoProduct]] = p
+	}
+	p.info = info
+	p.expires = expires
+	if !slices.Contains(p.requests, r) {
+		p.requests = append(p.requests, r)
+	}
+}
+
+// freshInfo returns info for product, or asks Apple again with the last
+// request it was given for if info has expired, as its asset tokens may no
+// longer work.
+func (s *Server) freshInfo(ctx context.Context, product string, info map[string]string, expires time.Time, requests []cache.Request) (map[string]string, error) {
+	if time.Now().Before(expires) {
+		return info, nil
+	}
+	r := requests[len(requests)-1]
+	req := client.ImageRequest{BoardID: r.BoardID, MLB: r.MLB, OSType: r.OSType, Diagnostics: r.Diagnostics}
+	info, err := s.upstreamInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if info[client.InfoProduct] != product {
+		return nil, fmt.Errorf("%s is no longer offered for %s, Apple now answers %s", product, r.BoardID, info[client.InfoProduct])
+	}
+	s.remember(req, info)
+	s.logf("info for %s refreshed from Apple", product)
+	return info, nil
+}
+
+func linkPath(link string) string {
+	if u, err := url.Parse(link); err == nil {
+		return u.Path
+	}
+	return link
+}
+
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/image/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	product, name := parts[0], parts[1]
+
+	entry, err := s.entry(r.Context(), product)
+	if err != nil {
+		s.logf("image %s: %v", product, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	file := entry.DMG()
+	if strings.HasSuffix(name, ".chunklist") {
+		file = entry.Chunklist()
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.logf("image %s/%s to %s", product, name, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// entry returns the cached image for product, fetching it from Apple if it
+// is not cached yet. Requests for a product being fetched wait for it.
+func (s *Server) entry(ctx context.Context, name string) (cache.Entry, error) {
+	if entry, ok := s.latestEntry(name); ok {
+		return entry, nil
+	}
+
+	s.mu.Lock()
+	f, running := s.fetches[name]
+	if !running {
+		p, known := s.products[name]
+		if !known {
+			s.mu.Unlock()
+			return cache.Entry{}, fmt.Errorf("unknown product %s, ask for image info first", name)
+		}
+		info, expires, requests := p.info, p.expires, append([]cache.Request(nil), p.requests...)
+		f = &fetch{done: make(chan struct{})}
+		s.fetches[name] = f
+		go func() {
+			// The download carries on for later requests if this client gives up
+			ctx := context.Background()
+			info, err := s.freshInfo(ctx, name, info, expires, requests)
+			if err == nil {
+				f.entry, f.err = s.download(ctx, info, requests)
+			} else {
+				f.err = err
+			}
+			s.mu.Lock()
+			delete(s.fetches, name)
+			s.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.entry, f.err
+	case <-ctx.Done():
+		return cache.Entry{}, ctx.Err()
+	}
+}
+
+// latestEntry finds the most recently used cache entry for product.
+func (s *Server) latestEntry(product string) (cache.Entry, bool) {
+	entries, err := s.Cache.List()
+	if err != nil {
+		return cache.Entry{}, false
+	}
+	for _, e := range entries {
+		if e.Product == product {
+			return e, true
+		}
+	}
+	return cache.Entry{}, false
+}
+
+// download fetches and verifies the image described by info and adds it to
+// the cache with the requests it answers.
+func (s *Server) download(ctx context.Context, info map[string]string, requests []cache.Request) (cache.Entry, error) {
+	product := info[client.InfoProduct]
+	s.logf("fetching %s from Apple", product)
+
+	tmpDir, err := os.MkdirTemp(s.Cache.Dir, "mirror-*.part")
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cnkPart, err := s.Client.SaveImage(ctx, info[client.InfoSignLink], info[client.InfoSignSess], cache.ChunklistName, tmpDir, nil)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	dmgPart, err := s.Client.SaveImage(ctx, info[client.InfoImageLink], info[client.InfoImageSess], cache.DMGName, tmpDir, nil)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+
+	cl, err := chunklist.ReadFile(cnkPart)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	if err := cl.Verify(ctx, dmgPart, s.Jobs, nil); err != nil {
+		return cache.Entry{}, fmt.Errorf("verification of %s failed: %v", product, err)
+	}
+
+	entry, err := s.Cache.Store(product, cl, dmgPart, cnkPart)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	if err := s.Cache.AddMetadata(entry, info, requests...); err != nil {
+		return cache.Entry{}, err
+	}
+	s.logf("cached %s", product)
+	return entry, nil
+}
@@ -0,0 +1,314 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/cache"
+	"github.com/DrDonk/recoveryOS/chunklist"
+	"github.com/DrDonk/recoveryOS/client"
+)
+
+const testProduct = "041-12345"
+
+// upstream is a fake of Apple's recovery server offering one image, whose
+// asset tokens work until the next image info answer or expireTokens.
+type upstream struct {
+	*httptest.Server
+	image, chunklist []byte
+
+	mu        sync.Mutex
+	sessions  int
+	infos     int
+	downloads int           // of the image
+	token     string        // the asset token that works
+	release   chan struct{} // if not nil, image downloads wait for it to close
+}
+
+// chunklistFor returns a chunklist of data as one chunk.
+func chunklistFor(data []byte) []byte {
+	header := chunklist.Header{
+		Magic:           [4]byte{'C', 'N', 'K', 'L'},
+		HeaderSize:      36,
+		FileVersion:     1,
+		ChunkMethod:     1,
+		SignatureMethod: chunklist.SignatureSHA256,
+		ChunkCount:      1,
+		ChunkOffset:     36,
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, chunklist.Chunk{Size: uint32(len(data)), Hash: sha256.Sum256(data)})
+	digest := sha256.Sum256(buf.Bytes())
+	buf.Write(digest[:])
+	return buf.Bytes()
+}
+
+func newUpstream(t *testing.T) *upstream {
+	t.Helper()
+	image := bytes.Repeat([]byte("recovery image "), 1000)
+	u := &upstream{image: image, chunklist: chunklistFor(image)}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) serve(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch r.URL.Path {
+	case "/":
+		u.sessions++
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprintf("UPSTREAM%d", u.sessions)})
+	case "/InstallationPayload/RecoveryImage":
+		body, _ := io.ReadAll(r.Body)
+		if !strings.HasPrefix(r.Header.Get("Cookie"), "session=UPSTREAM") {
+			http.Error(w, "no session", http.StatusForbidden)
+			return
+		}
+		if !strings.Contains(string(body), "bid=Mac-") {
+			http.Error(w, "unknown board", http.StatusForbidden)
+			return
+		}
+		u.infos++
+		u.token = fmt.Sprintf("token%d", u.infos)
+		files := u.URL + "/assets/" + testProduct + "/"
+		fmt.Fprintf(w, "AP: %s\nAU: %sBaseSystem.dmg\nAH: imagehash\nAT: %s\nCU: %sBaseSystem.chunklist\nCH: chunklisthash\nCT: %s\n",
+			testProduct, files, u.token, files, u.token)
+	case "/assets/" + testProduct + "/BaseSystem.dmg", "/assets/" + testProduct + "/BaseSystem.chunklist":
+		if u.token == "" || r.Header.Get("Cookie") != "AssetToken="+u.token {
+			http.Error(w, "token expired", http.StatusForbidden)
+			return
+		}
+		data := u.chunklist
+		if strings.HasSuffix(r.URL.Path, ".dmg") {
+			data = u.image
+			u.downloads++
+			if release := u.release; release != nil {
+				u.mu.Unlock()
+				<-release
+				u.mu.Lock()
+			}
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// count returns the sessions, image info answers and image downloads so far.
+func (u *upstream) count() (int, int, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.sessions, u.infos, u.downloads
+}
+
+// expireTokens stops every asset token given out so far from working.
+func (u *upstream) expireTokens() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.token = ""
+}
+
+// newMirror returns a mirror of u, a client of the mirror and the mirror's
+// address.
+func newMirror(t *testing.T, u *upstream) (*Server, *client.Client, string) {
+	t.Helper()
+	apple, err := client.New(client.Config{Server: u.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := cache.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(apple, store)
+	s.Jobs = 1
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	c, err := client.New(client.Config{Server: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c, server.URL
+}
+
+// askInfo opens a session with the mirror and asks it for image info.
+func askInfo(t *testing.T, c *client.Client, boardID string) (map[string]string, error) {
+	t.Helper()
+	session, err := c.Session(context.Background())
+	if err != nil {
+		t.Fatalf("Session: %v", err)
+	}
+	return c.ImageInfo(context.Background(), session, client.ImageRequest{BoardID: boardID, MLB: "00000000000000000", OSType: "default"})
+}
+
+// get fetches path from the mirror with the Range header rng if it is not
+// empty.
+func get(t *testing.T, base, path, rng string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, base+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+func TestInfo(t *testing.T) {
+	u := newUpstream(t)
+	_, c, base := newMirror(t, u)
+
+	for i := 0; i < 2; i++ {
+		info, err := askInfo(t, c, "Mac-827FAC58A8FDFA22")
+		if err != nil {
+			t.Fatalf("ImageInfo: %v", err)
+		}
+		// The links point at the mirror, the rest is Apple's answer
+		want := map[string]string{
+			client.InfoProduct:   testProduct,
+			client.InfoImageLink: base + "/image/" + testProduct + "/BaseSystem.dmg",
+			client.InfoImageHash: "imagehash",
+			client.InfoImageSess: "token1",
+			client.InfoSignLink:  base + "/image/" + testProduct + "/BaseSystem.chunklist",
+			client.InfoSignHash:  "chunklisthash",
+			client.InfoSignSess:  "token1",
+		}
+		for k, v := range want {
+			if info[k] != v {
+				t.Errorf("answer %d gives %s %q, want %q", i+1, k, info[k], v)
+			}
+		}
+	}
+	if sessions, infos, _ := u.count(); sessions != 1 || infos != 1 {
+		t.Errorf("Apple was asked for %d sessions and %d answers, want the first answer reused", sessions, infos)
+	}
+
+	// Apple's refusals are passed on
+	_, err := askInfo(t, c, "unknown")
+	if httpErr, ok := err.(*client.HTTPError); !ok || httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("ImageInfo error %v, want Apple's 403", err)
+	}
+}
+
+func TestInfoTTL(t *testing.T) {
+	u := newUpstream(t)
+	s, c, _ := newMirror(t, u)
+	s.InfoTTL = -time.Second // answers have expired as soon as they are kept
+
+	for i := 1; i <= 2; i++ {
+		info, err := askInfo(t, c, "Mac-827FAC58A8FDFA22")
+		if err != nil {
+			t.Fatalf("ImageInfo: %v", err)
+		}
+		if want := fmt.Sprintf("token%d", i); info[client.InfoImageSess] != want {
+			t.Errorf("answer %d has token %s, want a new answer with %s", i, info[client.InfoImageSess], want)
+		}
+	}
+	if _, infos, _ := u.count(); infos != 2 {
+		t.Errorf("Apple gave %d answers, want 2", infos)
+	}
+}
+
+func TestImage(t *testing.T) {
+	u := newUpstream(t)
+	_, c, base := newMirror(t, u)
+	dmg := "/image/" + testProduct + "/BaseSystem.dmg"
+
+	if status, _ := get(t, base, dmg, ""); status != http.StatusBadGateway {
+		t.Errorf("image asked for before its info gave %d, want %d", status, http.StatusBadGateway)
+	}
+	if _, err := askInfo(t, c, "Mac-827FAC58A8FDFA22"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients asking at once share one download
+	release := make(chan struct{})
+	u.mu.Lock()
+	u.release = release
+	u.mu.Unlock()
+	var wg sync.WaitGroup
+	results := make([][]byte, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(base + dmg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			results[i], _ = io.ReadAll(resp.Body)
+		}(i)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, _, downloads := u.count(); downloads > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // let the other clients join the download
+	close(release)
+	wg.Wait()
+	for i, data := range results {
+		if !bytes.Equal(data, u.image) {
+			t.Errorf("client %d got %d bytes, want the %d byte image", i, len(data), len(u.image))
+		}
+	}
+
+	// Later requests come from the cache, including parts of the image
+	status, data := get(t, base, dmg, "bytes=10-19")
+	if status != http.StatusPartialContent || !bytes.Equal(data, u.image[10:20]) {
+		t.Errorf("range request gave %d %q, want %d %q", status, data, http.StatusPartialContent, u.image[10:20])
+	}
+	if _, data := get(t, base, "/image/"+testProduct+"/BaseSystem.chunklist", ""); !bytes.Equal(data, u.chunklist) {
+		t.Error("chunklist differs from Apple's")
+	}
+	if _, _, downloads := u.count(); downloads != 1 {
+		t.Errorf("image downloaded %d times, want once", downloads)
+	}
+}
+
+func TestImageExpiredInfo(t *testing.T) {
+	u := newUpstream(t)
+	s, c, base := newMirror(t, u)
+	if _, err := askInfo(t, c, "Mac-827FAC58A8FDFA22"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the info has expired its tokens may no longer work, so the mirror
+	// asks again before downloading
+	s.mu.Lock()
+	s.products[testProduct].expires = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+	u.expireTokens()
+
+	status, data := get(t, base, "/image/"+testProduct+"/BaseSystem.dmg", "")
+	if status != http.StatusOK || !bytes.Equal(data, u.image) {
+		t.Fatalf("image request gave %d %.80q, want the image", status, data)
+	}
+	if _, infos, _ := u.count(); infos != 2 {
+		t.Errorf("Apple gave %d answers, want the expired one refreshed", infos)
+	}
+}
@@ -0,0 +1,47 @@
+package mlb_test
+
+import (
+	"testing"
+
+	"github.com/DrDonk/recoveryOS/catalog"
+	"github.com/DrDonk/recoveryOS/mlb"
+)
+
+// The MLBs in the built in catalog are sent to Apple as they are, so they
+// must all pass validation.
+func TestCatalogMLBs(t *testing.T) {
+	versions, err := catalog.LoadVersions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		info, err := mlb.Decode(v.MLB)
+		if err != nil {
+			t.Errorf("%s: MLB %s: %v", v.Name, v.MLB, err)
+			continue
+		}
+		if info.Format != mlb.FormatAnonymous {
+			t.Errorf("%s: MLB %s is %s, want %s", v.Name, v.MLB, info.Format, mlb.FormatAnonymous)
+		}
+	}
+}
+
+// Model codes are used to build MLBs for -model, so the ones the catalog has
+// must make valid anonymous MLBs.
+func TestCatalogModelCodes(t *testing.T) {
+	models, err := catalog.Models()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range models {
+		if m.BoardID == "" {
+			t.Errorf("%s has no board ID", m.Model)
+		}
+		if m.Code == "" {
+			continue
+		}
+		if _, err := mlb.FromCode(m.Code); err != nil {
+			t.Errorf("%s: code %s: %v", m.Model, m.Code, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package mlb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testLocations returns a three character location for each known
+// manufacturing location.
+func testLocations() []string {
+	var codes []string
+	for prefix := range locations {
+		codes = append(codes, (prefix + "00")[:3])
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func TestGenerateRoundTrip(t *testing.T) {
+	const code = "K3F7"
+	for year := 2010; year <= 2029; year++ {
+		for _, location := range testLocations() {
+			for _, week := range []int{0, 1, 26, 27, 53} {
+				name := fmt.Sprintf("%d/%s/%d", year, location, week)
+				mlb, serial, err := GeneratePair(code, year, week, location)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+
+				info, err := Decode(mlb)
+				if err != nil {
+					t.Fatalf("%s: generated %s does not validate: %v", name, mlb, err)
+				}
+				if info.Format != FormatFull || info.Location != location || info.Code != code || info.Year != year%10 {
+					t.Errorf("%s: generated %s decodes as %+v", name, mlb, info)
+				}
+				if week != 0 && info.Week != week {
+					t.Errorf("%s: generated %s has week %d", name, mlb, info.Week)
+				}
+				if LocationName(location) == "unknown" {
+					t.Errorf("%s: location has no name", name)
+				}
+
+				if len(serial) != 12 || !strings.HasPrefix(serial, location) || !strings.HasSuffix(serial, code) {
+					t.Errorf("%s: bad serial %s", name, serial)
+				}
+				// The serial's year character is for the same year and half
+				half := 0
+				if info.Week > 26 {
+					half = 1
+				}
+				if serial[3] != serialYears[(year%10)*2+half] {
+					t.Errorf("%s: serial %s has year %c for MLB week %d", name, serial, serial[3], info.Week)
+				}
+			}
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := []struct {
+		code     string
+		year     int
+		week     int
+		location string
+	}{
+		{"K3F", 2020, 1, "C02"},
+		{"K3FO", 2020, 1, "C02"},
+		{"K3F7", 2009, 1, "C02"},
+		{"K3F7", 2030, 1, "C02"},
+		{"K3F7", 2020, 54, "C02"},
+		{"K3F7", 2020, -1, "C02"},
+		{"K3F7", 2020, 1, "C2"},
+		{"K3F7", 2020, 1, "CI2"},
+	}
+	for _, tt := range tests {
+		if mlb, err := Generate(tt.code, tt.year, tt.week, tt.location); err == nil {
+			t.Errorf("Generate(%+v) = %s, want an error", tt, mlb)
+		}
+		if serial, err := GenerateSerial(tt.code, tt.year, tt.week, tt.location); err == nil {
+			t.Errorf("GenerateSerial(%+v) = %s, want an error", tt, serial)
+		}
+	}
+}
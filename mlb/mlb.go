@@ -0,0 +1,281 @@
+// Package mlb decodes, validates and generates Apple main logic board serial
+// numbers (MLBs) and the matching system serial numbers.
+//
+// A full 17 character MLB is laid out as PPP Y WW SSSSS EEEE X C: location,
+// year, week, unit number, EEEE model code, revision and checksum. Apple's
+// recovery server also accepts an anonymous form, 00000000000EEEE00, and a
+// product form, PPP00000000EEEE00, which carry no date or checksum.
+package mlb
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+const (
+	// Zero is the anonymous MLB that gets the generic recovery image.
+	Zero = "00000000000000000"
+	// Valid is a real MLB known to pass Apple's validation.
+	Valid = "F5K105303J9K3F71M"
+	// Product is the product form of Valid.
+	Product = "F5K00000000K3F700"
+
+	// Alphabet holds the MLB characters in checksum order. I and O are never used.
+	Alphabet = "0123456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+	// Length is the length of every MLB accepted here.
+	Length = 17
+)
+
+// Formats reported in Info.Format
+const (
+	FormatAnonymous = "anonymous"
+	FormatProduct   = "product"
+	FormatFull      = "full"
+)
+
+// Manufacturing locations by the first one or two characters of the code
+var locations = map[string]string{
+	"1C": "China",
+	"4H": "China",
+	"7J": "Hon Hai/Foxconn, China",
+	"C0": "Quanta Computer, China",
+	"C1": "Quanta Computer, China",
+	"C2": "Quanta Computer, China",
+	"C3": "Foxconn, Shenzhen China",
+	"C7": "Pentragon, Shanghai China",
+	"CK": "Cork, Ireland",
+	"CY": "Korea",
+	"DL": "Foxconn, China",
+	"DM": "Foxconn, China",
+	"E":  "Singapore",
+	"EE": "Taiwan",
+	"F":  "Fremont, USA",
+	"F1": "Foxconn, Zhengzhou China",
+	"F2": "Foxconn, Zhengzhou China",
+	"F5": "Foxconn, Zhengzhou China",
+	"F7": "China",
+	"FC": "Fountain Colorado, USA",
+	"FK": "Foxconn, Zhengzhou China",
+	"G8": "USA",
+	"MB": "Malaysia",
+	"PT": "Korea",
+	"QT": "Taiwan",
+	"RN": "Mexico",
+	"SG": "Singapore",
+	"UV": "Taiwan",
+	"VM": "Foxconn, Pardubice Czech Republic",
+	"W8": "Shanghai, China",
+	"WQ": "China",
+	"YM": "Hon Hai/Foxconn, China",
+}
+
+// Serial number year and week characters. Each year has two characters, one
+// for each half, and the sequence repeats every decade.
+const (
+	serialYears = "CDFGHJKLMNPQRSTVWXYZ"
+	serialWeeks = "123456789CDFGHJKLMNPQRTVWXY"
+)
+
+// Info holds the decoded fields of an MLB. Year is the single year digit, the
+// decade is not recorded. Date and checksum fields are only meaningful for
+// the full format.
+type Info struct {
+	MLB        string
+	Format     string
+	Location   string
+	Year       int
+	Week       int
+	Unit       string
+	Code       string
+	Revision   string
+	Checksum   string
+	ChecksumOK bool
+}
+
+// Checksum returns the weighted base 34 sum of mlb modulo 34, which is zero
+// for a correctly checksummed MLB. Characters in the same position parity as
+// the length are weighted by 3, the others by 1.
+func Checksum(mlb string) (int, error) {
+	sum := 0
+	for i := 0; i < len(mlb); i++ {
+		value := strings.IndexByte(Alphabet, mlb[i])
+		if value < 0 {
+			return 0, fmt.Errorf("invalid character %q at position %d", mlb[i], i+1)
+		}
+		if i&1 == len(mlb)&1 {
+			value *= 3
+		}
+		sum += value
+	}
+	return sum % len(Alphabet), nil
+}
+
+// Decode splits an MLB into its fields and checks its structure. The fields
+// found so far are returned even when there is an error.
+func Decode(mlb string) (Info, error) {
+	info := Info{MLB: mlb}
+	if len(mlb) != Length {
+		return info, fmt.Errorf("Cannot use MLBs in non 17 character format!")
+	}
+
+	sum, err := Checksum(mlb)
+	if err != nil {
+		return info, err
+	}
+	info.ChecksumOK = sum == 0
+
+	info.Location = mlb[0:3]
+	info.Unit = mlb[6:11]
+	info.Code = mlb[11:15]
+	info.Revision = mlb[15:16]
+	info.Checksum = mlb[16:17]
+
+	switch {
+	case strings.HasPrefix(mlb, "00000000000") && strings.HasSuffix(mlb, "00"):
+		info.Format = FormatAnonymous
+		info.Location = ""
+		return info, nil
+	case mlb[3:11] == "00000000" && strings.HasSuffix(mlb, "00"):
+		info.Format = FormatProduct
+		return info, nil
+	}
+
+	info.Format = FormatFull
+	if mlb[3] < '0' || mlb[3] > '9' {
+		return info, fmt.Errorf("invalid year %q, must be a digit", mlb[3])
+	}
+	info.Year = int(mlb[3] - '0')
+	if _, err := fmt.Sscanf(mlb[4:6], "%02d", &info.Week); err != nil || info.Week < 1 || info.Week > 53 {
+		return info, fmt.Errorf("invalid week %q, must be 01 to 53", mlb[4:6])
+	}
+	if !info.ChecksumOK {
+		return info, fmt.Errorf("invalid checksum")
+	}
+
+	return info, nil
+}
+
+// Validate rejects malformed MLBs before they are sent to Apple.
+func Validate(mlb string) error {
+	_, err := Decode(mlb)
+	return err
+}
+
+// LocationName gives the best known name for a manufacturing location code.
+func LocationName(location string) string {
+	if len(location) >= 2 {
+		if name, ok := locations[location[:2]]; ok {
+			return name
+		}
+	}
+	if len(location) >= 1 {
+		if name, ok := locations[location[:1]]; ok {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// FromCode returns the anonymous MLB for an EEEE model code.
+func FromCode(eeee string) (string, error) {
+	if len(eeee) != 4 {
+		return "", fmt.Errorf("invalid EEEE code length")
+	}
+	return fmt.Sprintf("00000000000%s00", eeee), nil
+}
+
+// ProductForm returns the anonymous MLB with the same EEEE code as mlb.
+func ProductForm(mlb string) string {
+	if len(mlb) < Length {
+		return mlb
+	}
+	return "00000000000" + mlb[11:15] + "00"
+}
+
+func randomChars(n int) string {
+	result := make([]byte, n)
+	for i := range result {
+		result[i] = Alphabet[rand.Intn(len(Alphabet))]
+	}
+	return string(result)
+}
+
+// checkGenerateArgs validates the generator settings and picks a random week
+// when week is zero.
+func checkGenerateArgs(code string, year, week int, location string) (int, error) {
+	if len(code) != 4 || strings.Trim(code, Alphabet) != "" {
+		return 0, fmt.Errorf("invalid EEEE code %s", code)
+	}
+	if len(location) != 3 || strings.Trim(location, Alphabet) != "" {
+		return 0, fmt.Errorf("invalid location %s, must be 3 characters", location)
+	}
+	if year < 2010 || year > 2029 {
+		return 0, fmt.Errorf("invalid year %d, must be 2010 to 2029", year)
+	}
+	if week == 0 {
+		week = rand.Intn(52) + 1
+	}
+	if week < 1 || week > 53 {
+		return 0, fmt.Errorf("invalid week %d, must be 1 to 53", week)
+	}
+	return week, nil
+}
+
+// Generate returns a random MLB with a correct checksum for the EEEE code,
+// manufacturing year, week and location. A week of zero picks one at random.
+func Generate(code string, year, week int, location string) (string, error) {
+	week, err := checkGenerateArgs(code, year, week, location)
+	if err != nil {
+		return "", err
+	}
+
+	mlb := fmt.Sprintf("%s%d%02d%s%s%s", location, year%10, week, randomChars(5), code, randomChars(1))
+
+	// The check character is weighted by 1, so it just needs to bring the sum
+	// up to a multiple of 34
+	sum, err := Checksum(mlb + "0")
+	if err != nil {
+		return "", err
+	}
+	return mlb + string(Alphabet[(len(Alphabet)-sum)%len(Alphabet)]), nil
+}
+
+// GenerateSerial returns a random 12 character system serial number for the
+// EEEE code, manufacturing year, week and location. A week of zero picks one
+// at random.
+func GenerateSerial(code string, year, week int, location string) (string, error) {
+	week, err := checkGenerateArgs(code, year, week, location)
+	if err != nil {
+		return "", err
+	}
+
+	half := 0
+	if week > 26 {
+		half = 1
+		week -= 26
+	}
+	yearChar := serialYears[(year%10)*2+half]
+	weekChar := serialWeeks[week-1]
+
+	return fmt.Sprintf("%s%c%c%s%s", location, yearChar, weekChar, randomChars(3), code), nil
+}
+
+// GeneratePair returns an MLB and serial number that share a manufacturing
+// date, so they look like they came from the same machine.
+func GeneratePair(code string, year, week int, location string) (string, string, error) {
+	week, err := checkGenerateArgs(code, year, week, location)
+	if err != nil {
+		return "", "", err
+	}
+	mlb, err := Generate(code, year, week, location)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := GenerateSerial(code, year, week, location)
+	if err != nil {
+		return "", "", err
+	}
+	return mlb, serial, nil
+}
@@ -0,0 +1,89 @@
+package mlb
+
+import "testing"
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		mlb  string
+		want int
+	}{
+		{Valid, 0},
+		{Zero, 0},
+		{"F5K105303J9K3F71N", 1}, // check character one too high
+		{"F5K105303J9K3F71L", 33},
+		{"G5K105303J9K3F71M", 1}, // weighted position changed
+		{"F6K105303J9K3F71M", 3},
+	}
+	for _, tt := range tests {
+		got, err := Checksum(tt.mlb)
+		if err != nil {
+			t.Errorf("Checksum(%s): %v", tt.mlb, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Checksum(%s) = %d, want %d", tt.mlb, got, tt.want)
+		}
+	}
+
+	// I and O are not in the alphabet
+	for _, mlb := range []string{"F5K105303J9K3F7IM", "F5K105303J9K3F7OM", "F5K105303J9K3F7-M", "f5k105303j9k3f71m"} {
+		if _, err := Checksum(mlb); err == nil {
+			t.Errorf("Checksum(%s) accepted an invalid character", mlb)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		mlb    string
+		format string
+		ok     bool
+	}{
+		{Valid, FormatFull, true},
+		{Product, FormatProduct, true},
+		{Zero, FormatAnonymous, true},
+		{"00000000000J80300", FormatAnonymous, true},
+		{"00000000000KXPG00", FormatAnonymous, true},
+		{"F5K105303J9K3F71N", FormatFull, false}, // bad checksum
+		{"F5K1X5303J9K3F71M", FormatFull, false}, // bad week
+		{"F5KA05303J9K3F71M", FormatFull, false}, // bad year
+		{"F5K100303J9K3F71M", FormatFull, false}, // week 00
+		{"F5K105303J9K3F71", "", false},          // too short
+		{"F5K105303J9K3F71MM", "", false},        // too long
+		{"F5K105303J9K3F7OM", "", false},         // O is not used
+	}
+	for _, tt := range tests {
+		info, err := Decode(tt.mlb)
+		if (err == nil) != tt.ok {
+			t.Errorf("Decode(%s) error %v, want ok %v", tt.mlb, err, tt.ok)
+		}
+		if info.Format != tt.format {
+			t.Errorf("Decode(%s) format %q, want %q", tt.mlb, info.Format, tt.format)
+		}
+		if err := Validate(tt.mlb); (err == nil) != tt.ok {
+			t.Errorf("Validate(%s) error %v, want ok %v", tt.mlb, err, tt.ok)
+		}
+	}
+
+	info, err := Decode(Valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Info{MLB: Valid, Format: FormatFull, Location: "F5K", Year: 1, Week: 5, Unit: "303J9", Code: "K3F7", Revision: "1", Checksum: "M", ChecksumOK: true}
+	if info != want {
+		t.Errorf("Decode(%s) = %+v, want %+v", Valid, info, want)
+	}
+}
+
+func TestFromCode(t *testing.T) {
+	got, err := FromCode("J803")
+	if err != nil || got != "00000000000J80300" {
+		t.Errorf("FromCode(J803) = %s, %v", got, err)
+	}
+	if _, err := FromCode("J8030"); err == nil {
+		t.Error("FromCode accepted a 5 character code")
+	}
+	if got := ProductForm(Valid); got != "00000000000K3F700" {
+		t.Errorf("ProductForm(%s) = %s", Valid, got)
+	}
+}
@@ -0,0 +1,129 @@
+package vm
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DrDonk/recoveryOS/manifest"
+)
+
+// vmdkCapacity reads the virtual size in bytes from the header of a sparse
+// or streamOptimized VMDK.
+func vmdkCapacity(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var header struct {
+		Magic    [4]byte
+		Version  uint32
+		Flags    uint32
+		Capacity uint64 // sectors
+	}
+	if err := binary.Read(f, binary.LittleEndian, &header); err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	if string(header.Magic[:]) != "KDMV" {
+		return 0, fmt.Errorf("%s is not a sparse VMDK", path)
+	}
+	return int64(header.Capacity) * 512, nil
+}
+
+// OVA packs a streamOptimized VMDK of the recovery disk into an OVA at
+// output, with an OVF descriptor for a macOS guest with a blank install disk
+// and a manifest of their SHA-256 hashes.
+func OVA(cfg Config, streamVMDK, output string) error {
+	capacity, err := vmdkCapacity(streamVMDK)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(streamVMDK)
+	if err != nil {
+		return err
+	}
+
+	diskName := cfg.Name + "-disk1.vmdk"
+	g, err := newGuest(cfg, filepath.Dir(output), diskName, "")
+	if err != nil {
+		return err
+	}
+	g.DiskSize = info.Size()
+	g.DiskCapacity = capacity
+
+	ovf, err := render(g, "ovf.tmpl")
+	if err != nil {
+		return err
+	}
+	diskSum, _, err := manifest.HashFile(streamVMDK)
+	if err != nil {
+		return err
+	}
+	ovfName := cfg.Name + ".ovf"
+	mf := fmt.Sprintf("SHA256(%s)= %s\nSHA256(%s)= %s\n", ovfName, sha256Hex(ovf), diskName, diskSum)
+
+	part := output + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+
+	// OVA order is the descriptor, then the manifest, then the disks
+	tw := tar.NewWriter(f)
+	now := time.Now()
+	err = addBytes(tw, ovfName, ovf, now)
+	if err == nil {
+		err = addBytes(tw, cfg.Name+".mf", []byte(mf), now)
+	}
+	if err == nil {
+		err = addDisk(tw, diskName, streamVMDK, info.Size(), now)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(part, output)
+}
+
+func addBytes(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime, Format: tar.FormatUSTAR}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func addDisk(tw *tar.Writer, name, path string, size int64, modTime time.Time) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Format: tar.FormatUSTAR}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, in)
+	return err
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
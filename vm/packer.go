@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// PackerSuffix is added to the VM name for the Packer template.
+const PackerSuffix = ".pkr.hcl"
+
+// Packer writes a Packer template to dir with a qemu source that starts from
+// a copy of the QCOW2 recovery disk, and a vmware-vmx source cloning the
+// VMware VM if one has been created in dir. It returns the files created.
+func Packer(cfg Config, recoveryQCOW2, dir string) ([]string, error) {
+	rel, err := filepath.Rel(dir, recoveryQCOW2)
+	if err != nil {
+		return nil, err
+	}
+	g, err := newGuest(cfg, dir, filepath.ToSlash(rel), "")
+	if err != nil {
+		return nil, err
+	}
+	vmx := filepath.Join(g.Dir, cfg.Name+VMwareSuffix, cfg.Name+".vmx")
+	if _, err := os.Stat(vmx); err == nil {
+		g.VMX = vmx
+	}
+	// Backslashes are escapes in HCL strings, Packer takes / on Windows too
+	g.Dir = filepath.ToSlash(g.Dir)
+	g.VMX = filepath.ToSlash(g.VMX)
+	g.OpenCore = filepath.ToSlash(g.OpenCore)
+	g.OVMFCode = filepath.ToSlash(g.OVMFCode)
+	g.OVMFVars = filepath.ToSlash(g.OVMFVars)
+
+	template := filepath.Join(dir, cfg.Name+PackerSuffix)
+	if err := writeTemplate(g, "packer.pkr.hcl.tmpl", template, 0644); err != nil {
+		return nil, err
+	}
+	return []string{template}, nil
+}
@@ -0,0 +1,68 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// QEMU and libvirt file names, added to the VM name
+const (
+	QEMUScriptSuffix  = "-qemu.sh"
+	LibvirtSuffix     = "-libvirt.xml"
+	InstallDiskSuffix = "-install.qcow2"
+)
+
+// qemuGuest returns the template data for the QCOW2 recovery disk, creating
+// the blank install disk next to it unless it is already there.
+func qemuGuest(cfg Config, recoveryQCOW2, dir string) (Guest, []string, error) {
+	rel, err := filepath.Rel(dir, recoveryQCOW2)
+	if err != nil {
+		return Guest{}, nil, err
+	}
+	g, err := newGuest(cfg, dir, filepath.ToSlash(rel), cfg.Name+InstallDiskSuffix)
+	if err != nil {
+		return Guest{}, nil, err
+	}
+
+	install := filepath.Join(dir, g.InstallDisk)
+	if _, err := os.Stat(install); err == nil {
+		return g, nil, nil
+	}
+	if err := qemuImg("create", "-q", "-f", "qcow2", install, fmt.Sprintf("%dG", cfg.DiskGB)); err != nil {
+		return Guest{}, nil, err
+	}
+	return g, []string{install}, nil
+}
+
+// QEMUScript writes a shell script to dir that starts the VM with
+// qemu-system-x86_64 and KVM, and creates the blank install disk if needed.
+// It returns the files created.
+func QEMUScript(cfg Config, recoveryQCOW2, dir string) ([]string, error) {
+	g, files, err := qemuGuest(cfg, recoveryQCOW2, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	script := filepath.Join(dir, cfg.Name+QEMUScriptSuffix)
+	if err := writeTemplate(g, "qemu.sh.tmpl", script, 0755); err != nil {
+		return nil, err
+	}
+	return append(files, script), nil
+}
+
+// Libvirt writes a libvirt domain to dir that can be loaded with virsh
+// define, and creates the blank install disk if needed. It returns the files
+// created.
+func Libvirt(cfg Config, recoveryQCOW2, dir string) ([]string, error) {
+	g, files, err := qemuGuest(cfg, recoveryQCOW2, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := filepath.Join(dir, cfg.Name+LibvirtSuffix)
+	if err := writeTemplate(g, "libvirt.xml.tmpl", domain, 0644); err != nil {
+		return nil, err
+	}
+	return append(files, domain), nil
+}
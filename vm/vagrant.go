@@ -0,0 +1,161 @@
+package vm
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Vagrant box file names, added to the VM name
+const (
+	VagrantVMwareSuffix  = "-vmware.box"
+	VagrantLibvirtSuffix = "-libvirt.box"
+)
+
+// qcow2Capacity reads the virtual size in bytes from the header of a QCOW2
+// disk.
+func qcow2Capacity(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var header struct {
+		Magic         [4]byte
+		Version       uint32
+		BackingOffset uint64
+		BackingSize   uint32
+		ClusterBits   uint32
+		Size          uint64
+	}
+	if err := binary.Read(f, binary.BigEndian, &header); err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	if string(header.Magic[:]) != "QFI\xfb" {
+		return 0, fmt.Errorf("%s is not a QCOW2 disk", path)
+	}
+	return int64(header.Size), nil
+}
+
+// VagrantVMware packs the VMDK recovery disk into a Vagrant box in dir for
+// the vmware_desktop provider, with a blank install disk and a Vagrantfile.
+// It returns the files created.
+func VagrantVMware(cfg Config, recoveryVMDK, dir string) ([]string, error) {
+	g, err := newGuest(cfg, dir, cfg.Name+"-recovery.vmdk", cfg.Name+".vmdk")
+	if err != nil {
+		return nil, err
+	}
+	vmx, err := render(g, "vmware.vmx.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	vagrantfile, err := render(g, "vagrant-vmware.rb.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	box := filepath.Join(dir, cfg.Name+VagrantVMwareSuffix)
+	install := box + ".install.part"
+	defer os.Remove(install)
+	if err := qemuImg("create", "-q", "-f", "vmdk", install, fmt.Sprintf("%dG", cfg.DiskGB)); err != nil {
+		return nil, err
+	}
+
+	err = writeBox(box, map[string]any{"provider": "vmware_desktop"}, vagrantfile, func(tw *tar.Writer, now time.Time) error {
+		if err := addBytes(tw, cfg.Name+".vmx", vmx, now); err != nil {
+			return err
+		}
+		if err := addFile(tw, g.RecoveryDisk, recoveryVMDK, now); err != nil {
+			return err
+		}
+		return addFile(tw, g.InstallDisk, install, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []string{box}, nil
+}
+
+// VagrantLibvirt packs the QCOW2 recovery disk into a Vagrant box in dir for
+// the libvirt provider, with a Vagrantfile adding the blank install disk. It
+// returns the files created.
+func VagrantLibvirt(cfg Config, recoveryQCOW2, dir string) ([]string, error) {
+	capacity, err := qcow2Capacity(recoveryQCOW2)
+	if err != nil {
+		return nil, err
+	}
+	g, err := newGuest(cfg, dir, "box.img", "")
+	if err != nil {
+		return nil, err
+	}
+	vagrantfile, err := render(g, "vagrant-libvirt.rb.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	// virtual_size is in whole GB
+	metadata := map[string]any{
+		"provider":     "libvirt",
+		"format":       "qcow2",
+		"virtual_size": (capacity + 1<<30 - 1) >> 30,
+	}
+	box := filepath.Join(dir, cfg.Name+VagrantLibvirtSuffix)
+	err = writeBox(box, metadata, vagrantfile, func(tw *tar.Writer, now time.Time) error {
+		return addFile(tw, g.RecoveryDisk, recoveryQCOW2, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []string{box}, nil
+}
+
+// writeBox writes a Vagrant box to path, an uncompressed tar holding
+// metadata.json, the Vagrantfile and the files added by addDisks. The disks
+// hold a compressed DMG so gzip would save little.
+func writeBox(path string, metadata map[string]any, vagrantfile []byte, addDisks func(*tar.Writer, time.Time) error) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	part := path + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+
+	tw := tar.NewWriter(f)
+	now := time.Now()
+	err = addBytes(tw, "metadata.json", append(data, '\n'), now)
+	if err == nil {
+		err = addBytes(tw, "Vagrantfile", vagrantfile, now)
+	}
+	if err == nil {
+		err = addDisks(tw, now)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(part, path)
+}
+
+// addFile adds the file at path to tw as name.
+func addFile(tw *tar.Writer, name, path string, modTime time.Time) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return addDisk(tw, name, path, info.Size(), modTime)
+}
@@ -0,0 +1,230 @@
+// Package vm creates virtual machine definitions around a recoveryOS disk,
+// with the firmware, SMC, board ID and devices a macOS guest needs.
+//
+// The definitions are written from text/template files built into the
+// package. Any of them can be replaced by putting a file with the same name
+// in Config.TemplateDir, or one named <os>-<template> to replace it for a
+// single macOS version, for example sonoma-vmware.vmx.tmpl.
+package vm
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/DrDonk/recoveryOS/catalog"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// Config describes the virtual machine to create.
+type Config struct {
+	Name        string            // VM and file name, e.g. sonoma
+	OS          catalog.OSVersion // macOS version of the recovery image
+	CPUs        int
+	MemoryMB    int
+	DiskGB      int    // size of the blank disk macOS is installed on
+	TemplateDir string // folder of templates replacing the built in ones
+	OVMFCode    string // OVMF firmware for QEMU and libvirt
+	OVMFVars    string // OVMF variable store copied for each VM
+	OpenCore    string // OpenCore boot disk for QEMU and libvirt, raw or qcow2
+}
+
+// DefaultConfig returns the settings used unless others are given.
+func DefaultConfig(name string, v catalog.OSVersion) Config {
+	return Config{
+		Name:     name,
+		OS:       v,
+		CPUs:     2,
+		MemoryMB: 8192,
+		DiskGB:   100,
+		OVMFCode: "/usr/share/OVMF/OVMF_CODE.fd",
+		OVMFVars: "/usr/share/OVMF/OVMF_VARS.fd",
+	}
+}
+
+// Guest is the data the templates are filled in with.
+type Guest struct {
+	Config
+	Darwin         int    // Darwin major version of the macOS release
+	Dir            string // absolute path of the folder holding the disks
+	RecoveryDisk   string // file name of the recovery disk
+	InstallDisk    string // file name of the blank install disk
+	DiskSize       int64  // size of the recovery disk file, set for OVF
+	DiskCapacity   int64  // virtual size of the recovery disk in bytes, set for OVF
+	InstallBytes   int64  // size of the install disk in bytes
+	VMwareGuestOS  string
+	VMwareGuestID  string // guest type as vSphere names it
+	VMwareNIC      string
+	QEMUNIC        string
+	LibvirtNIC     string // network model as libvirt names it
+	OpenCoreFormat string // raw or qcow2
+	VMX            string // VMware VM the Packer template clones, if there is one
+}
+
+// newGuest fills in the template data for cfg and the disk names.
+func newGuest(cfg Config, dir, recoveryDisk, installDisk string) (Guest, error) {
+	darwin, err := Darwin(cfg.OS)
+	if err != nil {
+		return Guest{}, err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return Guest{}, err
+	}
+	if cfg.OpenCore != "" {
+		if cfg.OpenCore, err = filepath.Abs(cfg.OpenCore); err != nil {
+			return Guest{}, err
+		}
+	}
+
+	g := Guest{
+		Config:         cfg,
+		Darwin:         darwin,
+		Dir:            dir,
+		RecoveryDisk:   recoveryDisk,
+		InstallDisk:    installDisk,
+		InstallBytes:   int64(cfg.DiskGB) << 30,
+		VMwareGuestOS:  fmt.Sprintf("darwin%d-64", darwin),
+		VMwareGuestID:  fmt.Sprintf("darwin%d_64Guest", darwin),
+		VMwareNIC:      "vmxnet3",
+		QEMUNIC:        "virtio-net-pci",
+		LibvirtNIC:     "virtio",
+		OpenCoreFormat: "raw",
+	}
+	// Lion to Yosemite have no vmxnet3 or e1000e driver, but VMware's e1000
+	// is the Intel 82545EM they do support
+	if darwin < 15 {
+		g.VMwareNIC = "e1000"
+	}
+	// virtio networking arrived in Big Sur, and Lion to Yosemite only have
+	// a driver for the Intel 82545EM of the emulated cards
+	switch {
+	case darwin < 15:
+		g.QEMUNIC = "e1000-82545em"
+		g.LibvirtNIC = "e1000-82545em"
+	case darwin < 20:
+		g.QEMUNIC = "vmxnet3"
+		g.LibvirtNIC = "vmxnet3"
+	}
+	if strings.EqualFold(filepath.Ext(cfg.OpenCore), ".qcow2") {
+		g.OpenCoreFormat = "qcow2"
+	}
+	// VMware has no guest type newer than darwin24-64 yet
+	if darwin > 24 {
+		g.VMwareGuestOS = "darwin24-64"
+		g.VMwareGuestID = "darwin24_64Guest"
+	}
+	return g, nil
+}
+
+// Darwin returns the Darwin major version of a macOS release, 23 for macOS
+// 14 or 11 for 10.7.
+func Darwin(v catalog.OSVersion) (int, error) {
+	parts := strings.Split(v.Version, ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("%s has no version number", v.Name)
+	}
+
+	switch {
+	case major == 10 && len(parts) > 1:
+		minor, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, fmt.Errorf("%s has a bad version number %s", v.Name, v.Version)
+		}
+		return minor + 4, nil
+	case major >= 11 && major <= 15:
+		return major + 9, nil
+	case major >= 26:
+		// Versions follow the year from macOS 26
+		return major - 1, nil
+	}
+	return 0, fmt.Errorf("%s has an unknown version number %s", v.Name, v.Version)
+}
+
+// render fills in the template called name with g, taking it from the
+// template folder if there is one there.
+func render(g Guest, name string) ([]byte, error) {
+	var text []byte
+	var err error
+	if g.TemplateDir != "" {
+		for _, file := range []string{g.OS.Basename() + "-" + name, name} {
+			if text, err = os.ReadFile(filepath.Join(g.TemplateDir, file)); err == nil {
+				break
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	if text == nil {
+		if text, err = templates.ReadFile("templates/" + name); err != nil {
+			return nil, err
+		}
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, g); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeTemplate renders the template called name to path.
+func writeTemplate(g Guest, name, path string, perm os.FileMode) error {
+	data, err := render(g, name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// qemuImg runs qemu-img with args.
+func qemuImg(args ...string) error {
+	name := "qemu-img"
+	if runtime.GOOS == "windows" {
+		name = "qemu-img.exe"
+	}
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("qemu-img not found, it is needed to create the install disk")
+	}
+
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img %s failed: %v\n%s", args[0], err, out)
+	}
+	return nil
+}
+
+// copyFile copies src to dst, so the VM can change its disk without changing
+// the original.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
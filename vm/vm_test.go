@@ -0,0 +1,251 @@
+package vm
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/DrDonk/recoveryOS/catalog"
+	"github.com/DrDonk/recoveryOS/manifest"
+)
+
+func TestGuestNIC(t *testing.T) {
+	tests := []struct {
+		version               string
+		vmware, qemu, libvirt string
+	}{
+		{"10.7", "e1000", "e1000-82545em", "e1000-82545em"},
+		{"10.10", "e1000", "e1000-82545em", "e1000-82545em"},
+		{"10.11", "vmxnet3", "vmxnet3", "vmxnet3"},
+		{"10.15", "vmxnet3", "vmxnet3", "vmxnet3"},
+		{"11", "vmxnet3", "virtio-net-pci", "virtio"},
+		{"26", "vmxnet3", "virtio-net-pci", "virtio"},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig("test", catalog.OSVersion{Name: "macOS " + tt.version, Version: tt.version})
+		g, err := newGuest(cfg, t.TempDir(), "recovery.vmdk", "install.vmdk")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.version, err)
+		}
+		if g.VMwareNIC != tt.vmware || g.QEMUNIC != tt.qemu || g.LibvirtNIC != tt.libvirt {
+			t.Errorf("%s: NICs %s, %s and %s, want %s, %s and %s", tt.version, g.VMwareNIC, g.QEMUNIC, g.LibvirtNIC, tt.vmware, tt.qemu, tt.libvirt)
+		}
+	}
+}
+
+// testConfig returns the settings for a Sonoma guest.
+func testConfig() Config {
+	return DefaultConfig("sonoma", catalog.OSVersion{Name: "macOS Sonoma", Version: "14"})
+}
+
+// writeVMDK writes the header of a sparse VMDK of capacity bytes to path.
+func writeVMDK(t *testing.T, path string, capacity int64) {
+	t.Helper()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, struct {
+		Magic    [4]byte
+		Version  uint32
+		Flags    uint32
+		Capacity uint64
+	}{[4]byte{'K', 'D', 'M', 'V'}, 3, 0x30001, uint64(capacity / 512)})
+	buf.WriteString("disk data")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tarFile is one member of a tar file.
+type tarFile struct {
+	name string
+	data []byte
+}
+
+// readTar returns the members of the tar file at path in order.
+func readTar(t *testing.T, path string) []tarFile {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var files []tarFile
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, tarFile{header.Name, data})
+	}
+}
+
+func TestOVA(t *testing.T) {
+	dir := t.TempDir()
+	disk := filepath.Join(dir, "sonoma.stream.vmdk")
+	writeVMDK(t, disk, 2<<30)
+	output := filepath.Join(dir, "sonoma.ova")
+	if err := OVA(testConfig(), disk, output); err != nil {
+		t.Fatalf("OVA: %v", err)
+	}
+
+	files := readTar(t, output)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	if got, want := strings.Join(names, " "), "sonoma.ovf sonoma.mf sonoma-disk1.vmdk"; got != want {
+		t.Fatalf("OVA holds %s, want %s", got, want)
+	}
+
+	// The manifest lists the SHA-256 of the descriptor and the disk as packed
+	var want string
+	for _, f := range []tarFile{files[0], files[2]} {
+		sum := sha256.Sum256(f.data)
+		want += fmt.Sprintf("SHA256(%s)= %s\n", f.name, hex.EncodeToString(sum[:]))
+	}
+	if string(files[1].data) != want {
+		t.Errorf("manifest is\n%s\nwant\n%s", files[1].data, want)
+	}
+	if !bytes.Contains(files[0].data, []byte(`ovf:capacity="2147483648"`)) {
+		t.Error("descriptor does not give the disk capacity from the VMDK header")
+	}
+}
+
+// writeQCOW2 writes the header of a QCOW2 disk of size bytes to path.
+func writeQCOW2(t *testing.T, path string, size int64) {
+	t.Helper()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, struct {
+		Magic         [4]byte
+		Version       uint32
+		BackingOffset uint64
+		BackingSize   uint32
+		ClusterBits   uint32
+		Size          uint64
+	}{[4]byte{'Q', 'F', 'I', 0xfb}, 3, 0, 0, 16, uint64(size)})
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeQemuImg puts a qemu-img on PATH whose create writes an empty file.
+func fakeQemuImg(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake qemu-img is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = create ] && : > \"$5\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// boxMetadata returns the names in the box at path and its metadata.json.
+func boxMetadata(t *testing.T, path string) ([]string, map[string]any) {
+	t.Helper()
+	var names []string
+	var metadata map[string]any
+	for _, f := range readTar(t, path) {
+		names = append(names, f.name)
+		if f.name == "metadata.json" {
+			if err := json.Unmarshal(f.data, &metadata); err != nil {
+				t.Fatalf("metadata.json: %v", err)
+			}
+		}
+	}
+	return names, metadata
+}
+
+func TestVagrantBoxes(t *testing.T) {
+	fakeQemuImg(t)
+	dir := t.TempDir()
+	vmdk := filepath.Join(dir, "sonoma.vmdk")
+	writeVMDK(t, vmdk, 2<<30)
+	qcow2 := filepath.Join(dir, "sonoma.qcow2")
+	writeQCOW2(t, qcow2, 2<<30+1) // part of a GB counts as a whole one
+
+	tests := []struct {
+		name     string
+		create   func(Config, string, string) ([]string, error)
+		disk     string
+		files    string // members of the box in order
+		provider string
+		size     float64 // virtual_size, zero for none
+	}{
+		{"vmware", VagrantVMware, vmdk, "metadata.json Vagrantfile sonoma.vmx sonoma-recovery.vmdk sonoma.vmdk", "vmware_desktop", 0},
+		{"libvirt", VagrantLibvirt, qcow2, "metadata.json Vagrantfile box.img", "libvirt", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := tt.create(testConfig(), tt.disk, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Fatalf("created %v, want one box", files)
+			}
+			names, metadata := boxMetadata(t, files[0])
+			if got := strings.Join(names, " "); got != tt.files {
+				t.Errorf("box holds %s, want %s", got, tt.files)
+			}
+			if metadata["provider"] != tt.provider {
+				t.Errorf("provider is %v, want %s", metadata["provider"], tt.provider)
+			}
+			if size, _ := metadata["virtual_size"].(float64); size != tt.size {
+				t.Errorf("virtual_size is %v, want %v", metadata["virtual_size"], tt.size)
+			}
+		})
+	}
+}
+
+func TestPackerChecksum(t *testing.T) {
+	dir := t.TempDir()
+	disk := filepath.Join(dir, "sonoma.qcow2")
+	writeQCOW2(t, disk, 2<<30)
+	files, err := Packer(testConfig(), disk, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The checksum file is the sidecar written with the disk's manifest
+	match := regexp.MustCompile(`iso_checksum\s*=\s*"file:([^"]*)"`).FindSubmatch(template)
+	if match == nil {
+		t.Fatalf("template has no iso_checksum file:\n%s", template)
+	}
+	sum, _, err := manifest.HashFile(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.WriteSidecar(disk, sum); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.FromSlash(string(match[1]))); err != nil {
+		t.Errorf("iso_checksum names a missing file: %v", err)
+	}
+	if want := filepath.ToSlash(disk + manifest.SidecarSuffix); string(match[1]) != want {
+		t.Errorf("iso_checksum is file:%s, want file:%s", match[1], want)
+	}
+}
@@ -0,0 +1,54 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// VMwareSuffix is added to the name of the VM folder, which Fusion opens as
+// a single VM and Workstation as a normal folder.
+const VMwareSuffix = ".vmwarevm"
+
+// VMware creates a VMware virtual machine in a folder in dir, with a copy of
+// the VMDK recovery disk and a blank install disk. It returns the files
+// created.
+func VMware(cfg Config, recoveryVMDK, dir string) ([]string, error) {
+	bundle := filepath.Join(dir, cfg.Name+VMwareSuffix)
+	if _, err := os.Stat(bundle); err == nil {
+		return nil, fmt.Errorf("%s already exists", bundle)
+	}
+
+	g, err := newGuest(cfg, bundle, cfg.Name+"-recovery.vmdk", cfg.Name+".vmdk")
+	if err != nil {
+		return nil, err
+	}
+
+	// Build in a temporary folder so a failure leaves nothing behind
+	part := bundle + ".part"
+	os.RemoveAll(part)
+	if err := os.MkdirAll(part, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(part)
+
+	if err := copyFile(recoveryVMDK, filepath.Join(part, g.RecoveryDisk)); err != nil {
+		return nil, err
+	}
+	if err := qemuImg("create", "-q", "-f", "vmdk", filepath.Join(part, g.InstallDisk), fmt.Sprintf("%dG", cfg.DiskGB)); err != nil {
+		return nil, err
+	}
+	vmx := cfg.Name + ".vmx"
+	if err := writeTemplate(g, "vmware.vmx.tmpl", filepath.Join(part, vmx), 0644); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(part, bundle); err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range []string{vmx, g.RecoveryDisk, g.InstallDisk} {
+		files = append(files, filepath.Join(bundle, name))
+	}
+	return files, nil
+}